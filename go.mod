@@ -1,6 +1,6 @@
 module github.com/morgangallant/logs
 
-go 1.15
+go 1.21
 
 require (
 	crawshaw.io/sqlite v0.3.2
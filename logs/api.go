@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeJSONError replies with an error of the form {"error": msg}.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(struct {
+		Error string `json:"error"`
+	}{msg}); err != nil {
+		slog.Error("Failed to write error response.", "err", err)
+	}
+}
+
+// apiLog is the JSON representation of a log used by the API.
+type apiLog struct {
+	ID        int64     `json:"id,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Content   string    `json:"content"`
+	Stream    string    `json:"stream,omitempty"`
+}
+
+func apiLogsHandler(db *sql.DB) http.HandlerFunc {
+	list := basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		listLogs(db, w, r)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			list(w, r)
+		case http.MethodPost:
+			createLog(db, w, r)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// apiLogHandler serves a single log, identified by the id at the end of the
+// path, as in /api/logs/42.
+func apiLogHandler(db *sql.DB) http.HandlerFunc {
+	get := basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		getLog(db, w, r)
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			get(w, r)
+		case http.MethodDelete:
+			removeLog(db, w, r)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// parseLogID returns the id at the end of r's path.
+func parseLogID(r *http.Request) (int64, error) {
+	v := strings.TrimPrefix(r.URL.Path, "/api/logs/")
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 1 {
+		return 0, fmt.Errorf("invalid log id %q", v)
+	}
+	return id, nil
+}
+
+func getLog(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	id, err := parseLogID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	l, err := fetchLog(ctx, db, id)
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "log not found")
+		return
+	} else if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(apiLog{ID: l.id, Timestamp: l.ts, Content: l.content, Stream: l.stream}); err != nil {
+		slog.Error("Failed to write response.", "err", err)
+		return
+	}
+	slog.Info("Served API request.")
+}
+
+func removeLog(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if !validBearerToken(r, ingestToken) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	id, err := parseLogID(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	found, err := deleteLog(ctx, db, id)
+	if err != nil {
+		slog.Error("Failed to delete log.", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !found {
+		writeJSONError(w, http.StatusNotFound, "log not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	slog.Info("Deleted log from API.", "id", id)
+}
+
+// formatCursor returns the cursor of the page after l, made of its timestamp
+// and id, as in "2024-01-02T03:04:05.123456Z,42". The id breaks ties between
+// logs at the same time.
+func formatCursor(l log) string {
+	return l.ts.UTC().Format(time.RFC3339Nano) + "," + strconv.FormatInt(l.id, 10)
+}
+
+// parseCursor parses a cursor made by formatCursor. A bare timestamp is
+// accepted too, and is before every log at that time.
+func parseCursor(v string) (time.Time, int64, error) {
+	ts, id, ok := strings.Cut(v, ",")
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil || !ok {
+		return t, 0, err
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n < 0 {
+		return time.Time{}, 0, fmt.Errorf("invalid id %q", id)
+	}
+	return t, n, nil
+}
+
+// listLogs returns a page of logs in every stream, newest first. Pages can be
+// walked either by offset, or by passing the returned next cursor as the
+// before parameter, which is stable when new logs arrive in between requests.
+// The total number of logs and links to the neighbouring offset pages are
+// sent as headers.
+func listLogs(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePage(r)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var (
+		before   time.Time
+		beforeID int64
+	)
+	if v := r.URL.Query().Get("before"); v != "" {
+		if before, beforeID, err = parseCursor(v); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("invalid before %q, expected a next cursor or RFC3339", v))
+			return
+		}
+	}
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	// Fetch one extra log to find out whether there is a next page.
+	logs, err := fetchLogs(ctx, db, filter{before: before, beforeID: beforeID, limit: limit + 1, offset: offset, allStreams: true})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var resp struct {
+		Logs []apiLog `json:"logs"`
+		Next string   `json:"next,omitempty"`
+	}
+	if len(logs) > limit {
+		logs = logs[:limit]
+		resp.Next = formatCursor(logs[limit-1])
+	}
+	total, err := countLogs(ctx, db, filter{before: before, beforeID: beforeID, allStreams: true})
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	var links []string
+	if offset+limit < total {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(r, offset+limit)))
+	}
+	if offset > 0 {
+		prev := offset - limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(r, prev)))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	resp.Logs = make([]apiLog, len(logs))
+	for i, l := range logs {
+		resp.Logs[i] = apiLog{ID: l.id, Timestamp: l.ts, Content: l.content, Stream: l.stream}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.Error("Failed to write response.", "err", err)
+		return
+	}
+	slog.Info("Served API request.")
+}
+
+func createLog(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if !validBearerToken(r, ingestToken) {
+		writeJSONError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+	var req struct {
+		Content   string     `json:"content"`
+		Timestamp *time.Time `json:"timestamp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		writeJSONError(w, http.StatusBadRequest, "content must not be empty")
+		return
+	}
+	content, err := limitContent(req.Content)
+	if err != nil {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	l := log{ts: time.Now(), content: content}
+	if req.Timestamp != nil {
+		l.ts = *req.Timestamp
+	}
+	ctx, cancel := queryContext(r)
+	defer cancel()
+	if err := insertLog(ctx, db, l); err != nil {
+		slog.Error("Failed to insert new log.", "err", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(apiLog{Timestamp: l.ts, Content: l.content}); err != nil {
+		slog.Error("Failed to write response.", "err", err)
+		return
+	}
+	slog.Info("Ingested log from API.", "bytes", len(l.content))
+}
+
+// countHandler returns the number of logs in every stream, optionally only those matching the
+// q, from and to parameters.
+func countHandler(db *sql.DB, tz *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		from, to, err := parseRange(r, tz)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		n, err := countLogs(ctx, db, filter{query: r.URL.Query().Get("q"), from: from, to: to, allStreams: true})
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Count int `json:"count"`
+		}{n}); err != nil {
+			slog.Error("Failed to write response.", "err", err)
+			return
+		}
+		slog.Info("Served count request.")
+	}
+}
+
+// importHandler bulk imports logs, given either as a JSON array of objects
+// like those accepted by POST /api/logs, or as text with one log per line.
+func importHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !validBearerToken(r, ingestToken) {
+			writeJSONError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		var (
+			logs []log
+			err  error
+		)
+		now := time.Now()
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mt == "application/json" {
+			logs, err = parseJSONImport(r, now)
+		} else {
+			logs, err = parseTextImport(r, now)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for i := range logs {
+			if logs[i].content, err = limitContent(logs[i].content); err != nil {
+				writeJSONError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("entry %d: %v", i, err))
+				return
+			}
+		}
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		if err := insertLogs(ctx, db, logs); err != nil {
+			slog.Error("Failed to import logs.", "err", err)
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Imported int `json:"imported"`
+		}{len(logs)}); err != nil {
+			slog.Error("Failed to write response.", "err", err)
+			return
+		}
+		slog.Info("Imported logs.", "count", len(logs))
+	}
+}
+
+func parseJSONImport(r *http.Request, now time.Time) ([]log, error) {
+	var entries []struct {
+		Content   string     `json:"content"`
+		Timestamp *time.Time `json:"timestamp"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		return nil, err
+	}
+	logs := make([]log, len(entries))
+	for i, e := range entries {
+		if strings.TrimSpace(e.Content) == "" {
+			return nil, fmt.Errorf("entry %d: content must not be empty", i)
+		}
+		logs[i] = log{ts: now, content: e.Content}
+		if e.Timestamp != nil {
+			logs[i].ts = *e.Timestamp
+		}
+	}
+	return logs, nil
+}
+
+// parseTextImport reads one log per line, skipping blank lines. Each line is
+// timestamped a microsecond after the previous one to keep them in order.
+func parseTextImport(r *http.Request, now time.Time) ([]log, error) {
+	logs := []log{}
+	sc := bufio.NewScanner(r.Body)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			ts := now.Add(time.Duration(len(logs)) * time.Microsecond)
+			logs = append(logs, log{ts: ts, content: line})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
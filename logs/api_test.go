@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postLog sends body to createLog with the given bearer token.
+func postLog(db *sql.DB, token, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/logs", strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	createLog(db, w, r)
+	return w
+}
+
+func TestCreateLogRejects(t *testing.T) {
+	setConfig(t, &ingestToken, "token")
+	setConfig(t, &maxContentLen, 10)
+	setConfig(t, &truncateContent, false)
+	tests := []struct {
+		name, token, body string
+		want              int
+	}{
+		{"no token", "", `{"content": "hello"}`, http.StatusUnauthorized},
+		{"wrong token", "wrong", `{"content": "hello"}`, http.StatusUnauthorized},
+		{"invalid JSON", "token", `{"content": `, http.StatusBadRequest},
+		{"empty content", "token", `{"content": "  "}`, http.StatusBadRequest},
+		{"too long", "token", `{"content": "hello, world"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		// These are all rejected before the database is used.
+		if w := postLog(nil, tt.token, tt.body); w.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestCreateLog(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &ingestToken, "token")
+	w := postLog(db, "token", `{"content": "from cron", "timestamp": "2024-01-02T03:04:05Z"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	logs, err := fetchLogs(context.Background(), db, filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if len(logs) != 1 || logs[0].content != "from cron" || !logs[0].ts.Equal(want) {
+		t.Errorf("got %+v, want the posted log at %v", logs, want)
+	}
+}
+
+func TestParseTextImport(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	r := httptest.NewRequest("POST", "/api/import", strings.NewReader("first\n\n  second  \n"))
+	logs, err := parseTextImport(r, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].content != "first" || logs[1].content != "second" {
+		t.Fatalf("got %+v", logs)
+	}
+	if !logs[0].ts.Equal(now) || !logs[1].ts.After(logs[0].ts) {
+		t.Errorf("got timestamps %v and %v, want them in order from %v", logs[0].ts, logs[1].ts, now)
+	}
+}
+
+func TestParseJSONImport(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	body := `[{"content": "now"}, {"content": "then", "timestamp": "2020-01-01T00:00:00Z"}]`
+	logs, err := parseJSONImport(httptest.NewRequest("POST", "/api/import", strings.NewReader(body)), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || !logs[0].ts.Equal(now) || !logs[1].ts.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("got %+v", logs)
+	}
+	body = `[{"content": "fine"}, {"content": ""}]`
+	if _, err := parseJSONImport(httptest.NewRequest("POST", "/api/import", strings.NewReader(body)), now); err == nil {
+		t.Error("with empty content: got no error")
+	}
+}
+
+// postImport sends body to h as the given content type, with a valid token.
+func postImport(h http.HandlerFunc, contentType, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/import", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+ingestToken)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestImportHandler(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &ingestToken, "token")
+	h := importHandler(db)
+	if w := postImport(h, "text/plain", "one\ntwo\n"); w.Code != 200 || !strings.Contains(w.Body.String(), `"imported":2`) {
+		t.Errorf("text: got status %d: %s", w.Code, w.Body)
+	}
+	if w := postImport(h, "application/json", `[{"content": "three"}]`); w.Code != 200 || !strings.Contains(w.Body.String(), `"imported":1`) {
+		t.Errorf("JSON: got status %d: %s", w.Code, w.Body)
+	}
+	// Nothing is imported if any entry is invalid.
+	if w := postImport(h, "application/json", `[{"content": "four"}, {"content": " "}]`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid entry: got status %d, want 400", w.Code)
+	}
+	logs, err := fetchLogs(context.Background(), db, filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 3 {
+		t.Errorf("got %d logs, want 3", len(logs))
+	}
+}
+
+func TestImportHandlerRejectsInvalidToken(t *testing.T) {
+	setConfig(t, &ingestToken, "token")
+	r := httptest.NewRequest("POST", "/api/import", strings.NewReader("one"))
+	r.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	importHandler(nil)(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want 401", w.Code)
+	}
+}
+
+func TestWriteJSONError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSONError(w, http.StatusNotFound, "log not found")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	var resp map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || resp["error"] != "log not found" {
+		t.Errorf("got %v", resp)
+	}
+}
+
+func TestAPILogsHandlerMethodNotAllowed(t *testing.T) {
+	w := httptest.NewRecorder()
+	apiLogsHandler(nil)(w, httptest.NewRequest("PUT", "/api/logs", nil))
+	if w.Code != http.StatusMethodNotAllowed || !strings.HasPrefix(w.Body.String(), `{"error":`) {
+		t.Errorf("got status %d: %s", w.Code, w.Body)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, POST" {
+		t.Errorf("got Allow %q", allow)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	l := log{id: 42, ts: time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.FixedZone("", 3600))}
+	v := formatCursor(l)
+	if v != "2024-01-02T02:04:05.123456Z,42" {
+		t.Errorf("formatCursor = %q", v)
+	}
+	ts, id, err := parseCursor(v)
+	if err != nil || !ts.Equal(l.ts) || id != 42 {
+		t.Errorf("parseCursor(%q) = %v, %d, %v", v, ts, id, err)
+	}
+	// A bare timestamp is before every log at that time.
+	ts, id, err = parseCursor("2024-01-02T02:04:05Z")
+	if err != nil || !ts.Equal(time.Date(2024, 1, 2, 2, 4, 5, 0, time.UTC)) || id != 0 {
+		t.Errorf("with a bare timestamp: got %v, %d, %v", ts, id, err)
+	}
+	for _, v := range []string{"", "yesterday", "2024-01-02T02:04:05Z,x", "2024-01-02T02:04:05Z,-1"} {
+		if _, _, err := parseCursor(v); err == nil {
+			t.Errorf("parseCursor(%q): got no error", v)
+		}
+	}
+}
+
+// getLogs lists logs through apiLogsHandler, returning the response.
+func getLogs(t *testing.T, db *sql.DB, query string) (logs []apiLog, next string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	apiLogsHandler(db)(w, httptest.NewRequest("GET", "/api/logs?"+query, nil))
+	if w.Code != 200 {
+		t.Fatalf("%s: got status %d: %s", query, w.Code, w.Body)
+	}
+	var resp struct {
+		Logs []apiLog `json:"logs"`
+		Next string   `json:"next"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp.Logs, resp.Next
+}
+
+func TestListLogsCursor(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &totpKey, nil)
+	setConfig(t, &webUser, "")
+	setConfig(t, &webPassword, "")
+	// Several logs at the same time, which pages mustn't split or repeat.
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	mustInsert(t, db,
+		log{ts: ts.Add(-time.Minute), content: "e"},
+		log{ts: ts, content: "d"},
+		log{ts: ts, content: "c"},
+		log{ts: ts, content: "b"},
+		log{ts: ts.Add(time.Minute), content: "a"},
+	)
+	var got []string
+	query := "limit=2"
+	for pages := 0; ; pages++ {
+		if pages == 5 {
+			t.Fatal("too many pages")
+		}
+		logs, next := getLogs(t, db, query)
+		for _, l := range logs {
+			got = append(got, l.Content)
+		}
+		if next == "" {
+			break
+		}
+		query = "limit=2&before=" + url.QueryEscape(next)
+	}
+	if strings.Join(got, "") != "abcde" {
+		t.Errorf("got %q across pages, want each log once, newest first", got)
+	}
+}
+
+func TestCountHandler(t *testing.T) {
+	db := testDB(t)
+	mustInsert(t, db,
+		log{ts: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), content: "coffee"},
+		log{ts: time.Date(2024, 6, 2, 12, 0, 0, 0, time.UTC), content: "more coffee", stream: "work"},
+		log{ts: time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC), content: "tea"},
+	)
+	h := countHandler(db, time.UTC)
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 3},
+		{"q=coffee", 2},
+		{"from=2024-06-02", 2},
+		{"q=coffee&to=2024-06-01", 1},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/api/count?"+tt.query, nil))
+		if w.Code != 200 {
+			t.Fatalf("%q: got status %d: %s", tt.query, w.Code, w.Body)
+		}
+		var got struct {
+			Count int `json:"count"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Count != tt.want {
+			t.Errorf("%q: got count %d, want %d", tt.query, got.Count, tt.want)
+		}
+	}
+}
+
+func TestCountHandlerRejectsInvalidRange(t *testing.T) {
+	w := httptest.NewRecorder()
+	countHandler(nil, time.UTC)(w, httptest.NewRequest("GET", "/api/count?from=2024-06-02&to=2024-06-01", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestListLogsPaginationHeaders(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &totpKey, nil)
+	setConfig(t, &webUser, "")
+	setConfig(t, &webPassword, "")
+	setConfig(t, &maxRender, 1000)
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var logs []log
+	for i := 0; i < 7; i++ {
+		logs = append(logs, log{ts: ts.Add(time.Duration(i) * time.Minute), content: "log"})
+	}
+	mustInsert(t, db, logs...)
+	tests := []struct {
+		query, link string
+	}{
+		{"limit=2&offset=2", `</api/logs?limit=2&offset=4>; rel="next", </api/logs?limit=2&offset=0>; rel="prev"`},
+		{"limit=2", `</api/logs?limit=2&offset=2>; rel="next"`},
+		{"limit=2&offset=6", `</api/logs?limit=2&offset=4>; rel="prev"`},
+		{"limit=5&offset=3", `</api/logs?limit=5&offset=0>; rel="prev"`},
+		{"limit=10", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		apiLogsHandler(db)(w, httptest.NewRequest("GET", "/api/logs?"+tt.query, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: got status %d: %s", tt.query, w.Code, w.Body)
+		}
+		if total := w.Header().Get("X-Total-Count"); total != "7" {
+			t.Errorf("%s: got X-Total-Count %q, want 7", tt.query, total)
+		}
+		if link := w.Header().Get("Link"); link != tt.link {
+			t.Errorf("%s: got Link %q, want %q", tt.query, link, tt.link)
+		}
+	}
+}
+
+func TestParseLogID(t *testing.T) {
+	tests := []struct {
+		path string
+		want int64 // 0 for an invalid id.
+	}{
+		{"/api/logs/42", 42},
+		{"/api/logs/", 0},
+		{"/api/logs/0", 0},
+		{"/api/logs/-1", 0},
+		{"/api/logs/abc", 0},
+		{"/api/logs/42/", 0},
+	}
+	for _, tt := range tests {
+		id, err := parseLogID(httptest.NewRequest("GET", tt.path, nil))
+		if id != tt.want || (err == nil) != (tt.want != 0) {
+			t.Errorf("parseLogID(%q) = %d, %v, want %d", tt.path, id, err, tt.want)
+		}
+	}
+}
+
+// serveLog sends a request for a single log to apiLogHandler.
+func serveLog(db *sql.DB, method, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	apiLogHandler(db)(w, r)
+	return w
+}
+
+func TestAPILogHandlerRejects(t *testing.T) {
+	setConfig(t, &totpKey, nil)
+	setConfig(t, &webUser, "")
+	setConfig(t, &webPassword, "")
+	setConfig(t, &ingestToken, "token")
+	// Every request is rejected before the database is queried.
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", "/api/logs/abc", "", http.StatusBadRequest},
+		{"DELETE", "/api/logs/1", "", http.StatusUnauthorized},
+		{"DELETE", "/api/logs/1", "wrong", http.StatusUnauthorized},
+		{"DELETE", "/api/logs/abc", "token", http.StatusBadRequest},
+		{"PUT", "/api/logs/1", "token", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if w := serveLog(nil, tt.method, tt.path, tt.token); w.Code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
+
+func TestAPILogHandler(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &totpKey, nil)
+	setConfig(t, &webUser, "")
+	setConfig(t, &webPassword, "")
+	setConfig(t, &ingestToken, "token")
+	mustInsert(t, db, log{ts: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), content: "hello"})
+	w := serveLog(db, "GET", "/api/logs/1", "")
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var got apiLog
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != 1 || got.Content != "hello" {
+		t.Errorf("got %+v, want log 1", got)
+	}
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", "/api/logs/2", "", http.StatusNotFound},
+		{"DELETE", "/api/logs/1", "wrong", http.StatusUnauthorized},
+		{"DELETE", "/api/logs/1", "token", http.StatusNoContent},
+		{"DELETE", "/api/logs/1", "token", http.StatusNotFound},
+		{"GET", "/api/logs/1", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serveLog(db, tt.method, tt.path, tt.token); w.Code != tt.want {
+			t.Errorf("%s %s: got status %d, want %d", tt.method, tt.path, w.Code, tt.want)
+		}
+	}
+}
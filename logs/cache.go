@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// logsVersion is bumped whenever logs change, invalidating cached pages.
+var logsVersion uint64
+
+func invalidateCache() {
+	atomic.AddUint64(&logsVersion, 1)
+}
+
+// Maximum number of pages kept by a pageCache before it's emptied.
+const maxCachedPages = 100
+
+type cachedPage struct {
+	header http.Header
+	body   []byte
+	etag   string
+}
+
+// pageCache holds rendered responses keyed by their query parameters, valid
+// for as long as logsVersion is unchanged.
+type pageCache struct {
+	mu      sync.RWMutex
+	version uint64
+	pages   map[string]cachedPage
+}
+
+func newPageCache() *pageCache {
+	return &pageCache{pages: map[string]cachedPage{}}
+}
+
+func (c *pageCache) get(key string) (cachedPage, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.version != atomic.LoadUint64(&logsVersion) {
+		return cachedPage{}, false
+	}
+	p, ok := c.pages[key]
+	return p, ok
+}
+
+// put stores p, provided the logs haven't changed since version was read.
+func (c *pageCache) put(key string, version uint64, p cachedPage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version != version || len(c.pages) >= maxCachedPages {
+		c.version = version
+		c.pages = map[string]cachedPage{}
+	}
+	if version == atomic.LoadUint64(&logsVersion) {
+		c.pages[key] = p
+	}
+}
+
+// bufferWriter buffers a response so that it can be cached.
+type bufferWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (bw *bufferWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *bufferWriter) WriteHeader(status int) {
+	if bw.status == 0 {
+		bw.status = status
+	}
+}
+
+func (bw *bufferWriter) Write(b []byte) (int, error) {
+	if bw.status == 0 {
+		bw.status = http.StatusOK
+	}
+	return bw.body.Write(b)
+}
+
+// etagMatches reports whether the If-None-Match header of r matches etag, or
+// the ETag of its gzipped form.
+func etagMatches(r *http.Request, etag string) bool {
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == gzipETag(etag) || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// cached serves successful responses of next from c, along with an ETag so
+// that clients can make conditional requests.
+func cached(c *pageCache, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Whether deleted logs are shown depends on who's asking, so those
+		// pages can't be shared. See showDeleted.
+		if r.URL.Query().Has("include_deleted") {
+			next(w, r)
+			return
+		}
+		key := r.URL.Path + "?" + r.URL.Query().Encode()
+		p, ok := c.get(key)
+		if !ok {
+			version := atomic.LoadUint64(&logsVersion)
+			bw := &bufferWriter{header: http.Header{}}
+			next(bw, r)
+			if bw.status != http.StatusOK {
+				copyHeader(w.Header(), bw.header)
+				w.WriteHeader(bw.status)
+				w.Write(bw.body.Bytes())
+				return
+			}
+			sum := sha256.Sum256(bw.body.Bytes())
+			p = cachedPage{
+				header: bw.header,
+				body:   bw.body.Bytes(),
+				etag:   `"` + hex.EncodeToString(sum[:16]) + `"`,
+			}
+			c.put(key, version, p)
+		}
+		w.Header().Set("ETag", p.etag)
+		if etagMatches(r, p.etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		copyHeader(w.Header(), p.header)
+		w.Write(p.body)
+	}
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, vs := range src {
+		dst[k] = append([]string(nil), vs...)
+	}
+}
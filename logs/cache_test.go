@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// countingHandler writes the number of times it was called.
+func countingHandler(calls *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		fmt.Fprintf(w, "render %d", *calls)
+	}
+}
+
+func TestCached(t *testing.T) {
+	var calls int
+	h := cached(newPageCache(), countingHandler(&calls))
+	get := func(target string) string {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", target, nil))
+		return w.Body.String()
+	}
+
+	if got := get("/?tz=UTC"); got != "render 1" {
+		t.Fatalf("first request: got %q", got)
+	}
+	if got := get("/?tz=UTC"); got != "render 1" {
+		t.Errorf("identical request: got %q, want it served from the cache", got)
+	}
+	if got := get("/?tz=Europe/London"); got != "render 2" {
+		t.Errorf("different query: got %q, want it rendered again", got)
+	}
+	invalidateCache()
+	if got := get("/?tz=UTC"); got != "render 3" {
+		t.Errorf("after invalidateCache: got %q, want it rendered again", got)
+	}
+}
+
+func TestCachedSkipsErrors(t *testing.T) {
+	var calls int
+	h := cached(newPageCache(), func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "failed", http.StatusInternalServerError)
+	})
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("got status %d, want 500", w.Code)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("handler called %d times, want errors not to be cached", calls)
+	}
+}
+
+func TestCachedNotModified(t *testing.T) {
+	var calls int
+	h := cached(newPageCache(), countingHandler(&calls))
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/", nil))
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag header")
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("got status %d with %d bytes, want 304 and no body", w.Code, w.Body.Len())
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	const etag = `"abc"`
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{`"abc"`, true},
+		{`W/"abc"`, true},
+		{`"xyz", "abc"`, true},
+		{`"abc-gzip"`, true},
+		{"*", true},
+		{`"xyz"`, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("If-None-Match", tt.header)
+		if got := etagMatches(r, etag); got != tt.want {
+			t.Errorf("If-None-Match %q: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
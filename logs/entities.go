@@ -0,0 +1,207 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// entity is a Telegram message entity, marking up part of the text. Offsets
+// and lengths are in UTF-16 code units.
+type entity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+	URL    string `json:"url,omitempty"` // Only for text_link.
+}
+
+// marshalEntities encodes entities for the entities column, mapping none to
+// NULL.
+func marshalEntities(entities []entity) (sql.NullString, error) {
+	if len(entities) == 0 {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(entities)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+// unmarshalEntities decodes the entities column.
+func unmarshalEntities(b []byte) ([]entity, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	var entities []entity
+	if err := json.Unmarshal(b, &entities); err != nil {
+		return nil, fmt.Errorf("invalid entities: %w", err)
+	}
+	return entities, nil
+}
+
+// utf16Len returns the length of s in UTF-16 code units.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		n += utf16RuneLen(r)
+	}
+	return n
+}
+
+func utf16RuneLen(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// shiftEntities adjusts entities for text which had its first n UTF-16 code
+// units removed, dropping those which were entirely within them.
+func shiftEntities(entities []entity, n int) []entity {
+	if n == 0 {
+		return entities
+	}
+	var shifted []entity
+	for _, e := range entities {
+		end := e.Offset + e.Length - n
+		if end <= 0 {
+			continue
+		}
+		e.Offset -= n
+		if e.Offset < 0 {
+			e.Offset = 0
+		}
+		e.Length = end - e.Offset
+		shifted = append(shifted, e)
+	}
+	return shifted
+}
+
+// entityHref returns the link target of e, whose text is text, or "" if it
+// isn't a link or links somewhere which shouldn't be rendered.
+func entityHref(e entity, text string) string {
+	var href string
+	switch e.Type {
+	case "url":
+		href = text
+		if !strings.Contains(href, "://") {
+			href = "http://" + href
+		}
+	case "text_link":
+		href = e.URL
+	case "email":
+		href = "mailto:" + text
+	default:
+		return ""
+	}
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	switch u.Scheme {
+	case "http", "https", "mailto":
+		return u.String()
+	}
+	return ""
+}
+
+// entityTags returns the HTML tags wrapping an entity, or "" for entities
+// which aren't rendered.
+func entityTags(e entity, text string) (open, close string) {
+	switch e.Type {
+	case "bold":
+		return "<strong>", "</strong>"
+	case "italic":
+		return "<em>", "</em>"
+	case "underline":
+		return "<u>", "</u>"
+	case "strikethrough":
+		return "<s>", "</s>"
+	case "code":
+		return "<code>", "</code>"
+	case "pre":
+		return "<pre>", "</pre>"
+	}
+	if href := entityHref(e, text); href != "" {
+		return fmt.Sprintf(`<a href="%s" rel="nofollow noopener">`, html.EscapeString(href)), "</a>"
+	}
+	return "", ""
+}
+
+// renderContent returns log content as HTML. Content comes straight from
+// Telegram, so it's escaped before line breaks are turned into <br>s, and
+// entities are turned into the corresponding tags. Entities which overlap
+// without nesting, or don't fit the content, are ignored.
+func renderContent(content string, entities []entity) string {
+	// Map UTF-16 offsets to byte offsets, -1 for offsets in the middle of a
+	// surrogate pair.
+	byteAt := make([]int, 0, len(content)+1)
+	for i, r := range content {
+		byteAt = append(byteAt, i)
+		if utf16RuneLen(r) == 2 {
+			byteAt = append(byteAt, -1)
+		}
+	}
+	byteAt = append(byteAt, len(content))
+	type span struct {
+		start, end  int // Byte offsets.
+		open, close string
+	}
+	var spans []span
+	for _, e := range entities {
+		end := e.Offset + e.Length
+		if e.Offset < 0 || e.Length <= 0 || end >= len(byteAt) || byteAt[e.Offset] < 0 || byteAt[end] < 0 {
+			continue
+		}
+		s := span{start: byteAt[e.Offset], end: byteAt[end]}
+		if s.open, s.close = entityTags(e, content[s.start:s.end]); s.open != "" {
+			spans = append(spans, s)
+		}
+	}
+	// Outer entities open first.
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].start != spans[j].start {
+			return spans[i].start < spans[j].start
+		}
+		return spans[i].end > spans[j].end
+	})
+
+	var b strings.Builder
+	writeText := func(s string) {
+		s = html.EscapeString(s)
+		s = strings.ReplaceAll(s, "\r\n", "\n")
+		b.WriteString(strings.ReplaceAll(s, "\n", "<br>\n"))
+	}
+	var open []span
+	pos := 0
+	for _, s := range spans {
+		for len(open) > 0 && open[len(open)-1].end <= s.start {
+			top := open[len(open)-1]
+			writeText(content[pos:top.end])
+			b.WriteString(top.close)
+			pos = top.end
+			open = open[:len(open)-1]
+		}
+		if len(open) > 0 && s.end > open[len(open)-1].end {
+			continue
+		}
+		writeText(content[pos:s.start])
+		b.WriteString(s.open)
+		pos = s.start
+		open = append(open, s)
+	}
+	for len(open) > 0 {
+		top := open[len(open)-1]
+		writeText(content[pos:top.end])
+		b.WriteString(top.close)
+		pos = top.end
+		open = open[:len(open)-1]
+	}
+	writeText(content[pos:])
+	return b.String()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRenderContentLineBreaks(t *testing.T) {
+	tests := []struct{ content, want string }{
+		{"one line", "one line"},
+		{"first\nsecond", "first<br>\nsecond"},
+		{"<b>\n</b>", "&lt;b&gt;<br>\n&lt;/b&gt;"},
+	}
+	for _, tt := range tests {
+		if got := renderContent(tt.content, nil); got != tt.want {
+			t.Errorf("renderContent(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestRenderContentEntities(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		entities []entity
+		want     string
+	}{
+		{"text_link", "see here", []entity{{Type: "text_link", Offset: 4, Length: 4, URL: "https://example.com/?a=1&b=2"}},
+			`see <a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener">here</a>`},
+		{"url", "go to example.com now", []entity{{Type: "url", Offset: 6, Length: 11}},
+			`go to <a href="http://example.com" rel="nofollow noopener">example.com</a> now`},
+		{"unsafe link", "click", []entity{{Type: "text_link", Offset: 0, Length: 5, URL: "javascript:alert(1)"}}, "click"},
+		{"nested", "bold italic", []entity{{Type: "bold", Offset: 0, Length: 11}, {Type: "italic", Offset: 5, Length: 6}},
+			"<strong>bold <em>italic</em></strong>"},
+		{"overlapping", "abcdef", []entity{{Type: "bold", Offset: 0, Length: 4}, {Type: "italic", Offset: 2, Length: 4}},
+			"<strong>abcd</strong>ef"},
+		{"surrogate pair", "\U0001F600 <b>", []entity{{Type: "bold", Offset: 3, Length: 3}},
+			"\U0001F600 <strong>&lt;b&gt;</strong>"},
+		{"out of range", "hi", []entity{{Type: "bold", Offset: 0, Length: 5}}, "hi"},
+		{"inside surrogate pair", "\U0001F600", []entity{{Type: "bold", Offset: 1, Length: 1}}, "\U0001F600"},
+		{"unknown type", "#tag", []entity{{Type: "hashtag", Offset: 0, Length: 4}}, "#tag"},
+	}
+	for _, tt := range tests {
+		if got := renderContent(tt.content, tt.entities); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestShiftEntities(t *testing.T) {
+	entities := []entity{
+		{Type: "bold", Offset: 0, Length: 3},
+		{Type: "italic", Offset: 2, Length: 4},
+		{Type: "code", Offset: 6, Length: 2},
+	}
+	want := []entity{
+		{Type: "italic", Offset: 0, Length: 3},
+		{Type: "code", Offset: 3, Length: 2},
+	}
+	if got := shiftEntities(entities, 3); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if got := shiftEntities(entities, 0); !reflect.DeepEqual(got, entities) {
+		t.Errorf("shifting by 0: got %+v, want %+v", got, entities)
+	}
+}
+
+func TestUTF16Len(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"caf\u00e9", 4},
+		{"\U0001F600!", 3},
+	}
+	for _, tt := range tests {
+		if got := utf16Len(tt.s); got != tt.want {
+			t.Errorf("utf16Len(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMarshalEntities(t *testing.T) {
+	if v, err := marshalEntities(nil); err != nil || v.Valid {
+		t.Errorf("no entities: got %+v, %v, want NULL", v, err)
+	}
+	entities := []entity{{Type: "text_link", Offset: 1, Length: 2, URL: "https://example.com"}}
+	v, err := marshalEntities(entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := unmarshalEntities([]byte(v.String))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, entities) {
+		t.Errorf("got %+v, want %+v", got, entities)
+	}
+	if _, err := unmarshalEntities([]byte("{")); err == nil {
+		t.Error("invalid JSON: got no error")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How often the JSON Lines export is flushed to the client, in logs.
+const exportFlushInterval = 100
+
+// exportKey identifies a log across both databases without holding on to its
+// content, so migrated logs can be skipped when streaming the legacy ones.
+type exportKey struct {
+	ts  int64
+	sum uint64
+}
+
+func newExportKey(l log) exportKey {
+	h := fnv.New64a()
+	h.Write([]byte(l.content))
+	return exportKey{l.ts.UnixNano(), h.Sum64()}
+}
+
+// jsonlWriter writes logs as JSON Lines, flushing every exportFlushInterval.
+type jsonlWriter struct {
+	enc     *json.Encoder
+	flusher http.Flusher
+	n       int // The number of logs written.
+}
+
+func newJSONLWriter(w http.ResponseWriter) *jsonlWriter {
+	flusher, _ := w.(http.Flusher)
+	return &jsonlWriter{enc: json.NewEncoder(w), flusher: flusher}
+}
+
+func (jw *jsonlWriter) write(l log) error {
+	if err := jw.enc.Encode(apiLog{ID: l.id, Timestamp: l.ts, Content: l.content, Stream: l.stream}); err != nil {
+		return err
+	}
+	if jw.n++; jw.n%exportFlushInterval == 0 && jw.flusher != nil {
+		jw.flusher.Flush()
+	}
+	return nil
+}
+
+// clearWriteDeadline lifts HTTP_WRITE_TIMEOUT for the response to r, so that
+// exports which take a while aren't cut off part way through.
+func clearWriteDeadline(w http.ResponseWriter, r *http.Request) {
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		slog.Warn("Failed to clear write deadline.", "path", r.URL.Path, "err", err)
+	}
+}
+
+// mergeLogs writes the logs returned by next and nextLegacy, each oldest
+// first, merged by time. Migrated logs are in both, at the same time, so the
+// legacy copies of the logs written at the current time are skipped. Only
+// those are remembered, so memory use doesn't grow with the number of logs.
+func mergeLogs(next, nextLegacy func() (log, bool, error), write func(log) error) error {
+	l, ok, err := next()
+	if err != nil {
+		return err
+	}
+	ll, lok, err := nextLegacy()
+	if err != nil {
+		return err
+	}
+	var (
+		at     time.Time // The time of the last log written from next.
+		atKeys = map[exportKey]bool{}
+	)
+	for ok || lok {
+		// At equal times, the logs from next go first, so their legacy
+		// copies can be recognized.
+		if ok && (!lok || !ll.ts.Before(l.ts)) {
+			if !l.ts.Equal(at) {
+				at = l.ts
+				atKeys = map[exportKey]bool{}
+			}
+			atKeys[newExportKey(l)] = true
+			if err := write(l); err != nil {
+				return err
+			}
+			if l, ok, err = next(); err != nil {
+				return err
+			}
+			continue
+		}
+		if !ll.ts.Equal(at) || !atKeys[newExportKey(ll)] {
+			if err := write(ll); err != nil {
+				return err
+			}
+		}
+		if ll, lok, err = nextLegacy(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonlHandler streams every log, oldest first, as one JSON object per line.
+// Logs are written as they're read from the database rather than loaded into
+// memory first, and the write deadline is lifted, so this works for any
+// number of logs. Legacy logs are merged in by time, see mergeLogs.
+func jsonlHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Exports can take a while, so they're only bounded by the request.
+		ctx := r.Context()
+		clearWriteDeadline(w, r)
+		rows, err := db.QueryContext(ctx, "SELECT "+logColumns+" FROM logs WHERE deleted_at IS NULL ORDER BY timestamp ASC")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		next := func() (log, bool, error) {
+			if !rows.Next() {
+				return log{}, false, rows.Err()
+			}
+			l, err := scanLog(rows)
+			return l, err == nil, err
+		}
+		nextLegacy := func() (log, bool, error) { return log{}, false, nil }
+		if legacyPool != nil {
+			conn := legacyPool.Get(ctx)
+			if conn == nil {
+				http.Error(w, "failed to get sqlite conn from pool", http.StatusInternalServerError)
+				return
+			}
+			defer legacyPool.Put(conn)
+			stmt, err := conn.Prepare("SELECT ts, content FROM logs ORDER BY datetime(ts) ASC")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer stmt.Reset()
+			nextLegacy = func() (log, bool, error) {
+				for {
+					if hasNext, err := stmt.Step(); err != nil || !hasNext {
+						return log{}, false, err
+					}
+					if l, ok := scanLegacyLog(stmt); ok {
+						return l, true, nil
+					}
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="logs.jsonl"`)
+		jw := newJSONLWriter(w)
+		if err := mergeLogs(next, nextLegacy, jw.write); err != nil {
+			slog.Error("Failed to write JSON Lines export.", "err", err)
+			return
+		}
+		slog.Info("Served JSON Lines export.", "count", jw.n)
+	}
+}
+
+// incrementalHandler streams the logs with ids greater than the since
+// parameter, in order, as JSON Lines. The id to pass as since next time is
+// sent in the X-Last-ID header. Legacy logs have no id, so they're never
+// included.
+func incrementalHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var since int64
+		if v := r.URL.Query().Get("since"); v != "" {
+			var err error
+			if since, err = strconv.ParseInt(v, 10, 64); err != nil || since < 0 {
+				http.Error(w, "invalid since", http.StatusBadRequest)
+				return
+			}
+		}
+		ctx := r.Context()
+		clearWriteDeadline(w, r)
+		// Fix the end of the export up front, so the header can be sent
+		// before the logs and logs inserted meanwhile are left for next time.
+		var last sql.NullInt64
+		if err := db.QueryRowContext(ctx, "SELECT max(id) FROM logs WHERE id > $1", since).Scan(&last); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !last.Valid {
+			last.Int64 = since
+		}
+		stmt := "SELECT " + logColumns + " FROM logs WHERE id > $1 AND id <= $2 AND deleted_at IS NULL ORDER BY id ASC"
+		rows, err := db.QueryContext(ctx, stmt, since, last.Int64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("X-Last-ID", strconv.FormatInt(last.Int64, 10))
+		jw := newJSONLWriter(w)
+		for rows.Next() {
+			l, err := scanLog(rows)
+			if err != nil {
+				slog.Error("Failed to read incremental export.", "err", err)
+				return
+			}
+			if err := jw.write(l); err != nil {
+				slog.Error("Failed to write incremental export.", "err", err)
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			slog.Error("Failed to read incremental export.", "err", err)
+			return
+		}
+		slog.Info("Served incremental export.", "since", since, "last", last.Int64, "count", jw.n)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLWriter(t *testing.T) {
+	w := httptest.NewRecorder()
+	jw := newJSONLWriter(w)
+	for i := 0; i < exportFlushInterval-1; i++ {
+		if err := jw.write(log{id: int64(i + 1), ts: time.Now(), content: "line\nbreak"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Flushed {
+		t.Error("flushed before exportFlushInterval logs were written")
+	}
+	if err := jw.write(log{ts: time.Now(), content: "last"}); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Flushed {
+		t.Error("not flushed after exportFlushInterval logs were written")
+	}
+	sc := bufio.NewScanner(w.Body)
+	var n int
+	for sc.Scan() {
+		var l apiLog
+		if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+			t.Fatalf("line %d: %v", n+1, err)
+		}
+		n++
+	}
+	if n != exportFlushInterval || jw.n != n {
+		t.Errorf("got %d lines and %d logs written, want %d", n, jw.n, exportFlushInterval)
+	}
+}
+
+func TestJSONLHandler(t *testing.T) {
+	db := testDB(t)
+	now := time.Now()
+	mustInsert(t, db,
+		log{ts: now.Add(-time.Minute), content: "first"},
+		log{ts: now, content: "second", stream: "work"},
+	)
+	w := httptest.NewRecorder()
+	jsonlHandler(db)(w, httptest.NewRequest("GET", "/export.jsonl", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	var logs []apiLog
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		var l apiLog
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		logs = append(logs, l)
+	}
+	if len(logs) != 2 || logs[0].Content != "first" || logs[1].Stream != "work" {
+		t.Errorf("got %+v", logs)
+	}
+}
+
+// logIter returns a function returning logs one at a time, as mergeLogs
+// takes them.
+func logIter(logs ...log) func() (log, bool, error) {
+	return func() (log, bool, error) {
+		if len(logs) == 0 {
+			return log{}, false, nil
+		}
+		l := logs[0]
+		logs = logs[1:]
+		return l, true, nil
+	}
+}
+
+func TestMergeLogs(t *testing.T) {
+	at := func(m int) time.Time { return time.Date(2020, 1, 1, 0, m, 0, 0, time.UTC) }
+	var got []string
+	err := mergeLogs(
+		logIter(
+			log{ts: at(1), content: "a"},
+			log{ts: at(2), content: "migrated"},
+			log{ts: at(3), content: "c"},
+		),
+		logIter(
+			log{ts: at(0), content: "legacy"},
+			log{ts: at(2), content: "migrated"},
+			// At the same time as a migrated log, but not migrated itself.
+			log{ts: at(2), content: "b"},
+			log{ts: at(3), content: "c"},
+			log{ts: at(4), content: "last"},
+		),
+		func(l log) error {
+			got = append(got, l.content)
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"legacy", "a", "migrated", "b", "c", "last"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJSONLHandlerMergesLegacy(t *testing.T) {
+	db := testDB(t)
+	testLegacyPool(t,
+		[2]string{"2020-01-01T00:00:00Z", "legacy"},
+		[2]string{"2020-01-03T00:00:00Z", "migrated"},
+	)
+	mustInsert(t, db,
+		log{ts: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), content: "new"},
+		log{ts: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC), content: "migrated"},
+	)
+	w := httptest.NewRecorder()
+	jsonlHandler(db)(w, httptest.NewRequest("GET", "/export.jsonl", nil))
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		var l apiLog
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		got = append(got, l.Content)
+	}
+	if want := []string{"legacy", "new", "migrated"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestClearWriteDeadline(t *testing.T) {
+	// Wrapped as in run, so the deadline has to be reached through them.
+	h := logRequests(gzipped(func(w http.ResponseWriter, r *http.Request) {
+		clearWriteDeadline(w, r)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "slow export")
+	}))
+	srv := httptest.NewUnstartedServer(h)
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "slow export" {
+		t.Errorf("got %q, %v, want the whole export", body, err)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	tests := []struct {
+		query string
+		want  bool
+	}{
+		{"", false},
+		{"pretty", true},
+		{"pretty=1", true},
+		{"pretty=true", true},
+		{"pretty=0", false},
+		{"pretty=nope", false},
+	}
+	for _, tt := range tests {
+		if got := prettyJSON(httptest.NewRequest("GET", "/export.json?"+tt.query, nil)); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestJSONHandlerPretty(t *testing.T) {
+	db := testDB(t)
+	mustInsert(t, db, log{ts: time.Now(), content: "hello"})
+	h := jsonHandler(db)
+	get := func(query string) []byte {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/export.json"+query, nil))
+		if w.Code != 200 {
+			t.Fatalf("%q: got status %d: %s", query, w.Code, w.Body)
+		}
+		if !json.Valid(w.Body.Bytes()) {
+			t.Fatalf("%q: got invalid JSON %s", query, w.Body)
+		}
+		return w.Body.Bytes()
+	}
+	compact, pretty := get(""), get("?pretty")
+	if strings.Count(string(compact), "\n") != 1 {
+		t.Errorf("compact output isn't on one line:\n%s", compact)
+	}
+	if !strings.Contains(string(pretty), "\n  \"logs\": [") {
+		t.Errorf("pretty output isn't indented:\n%s", pretty)
+	}
+}
+
+func TestIncrementalHandlerRejectsInvalidSince(t *testing.T) {
+	for _, since := range []string{"-1", "abc", "1.5"} {
+		w := httptest.NewRecorder()
+		// since is checked before the database is queried.
+		incrementalHandler(nil)(w, httptest.NewRequest("GET", "/export/incremental?since="+since, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("since=%s: got status %d, want %d", since, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestIncrementalHandler(t *testing.T) {
+	db := testDB(t)
+	h := incrementalHandler(db)
+	// fetch returns the ids of the logs exported since the given id, and
+	// the id to continue from.
+	fetch := func(since string) ([]int64, string) {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/export/incremental?since="+since, nil))
+		if w.Code != 200 {
+			t.Fatalf("since=%s: got status %d: %s", since, w.Code, w.Body)
+		}
+		var ids []int64
+		for _, line := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var l apiLog
+			if err := json.Unmarshal([]byte(line), &l); err != nil {
+				t.Fatalf("%q: %v", line, err)
+			}
+			ids = append(ids, l.ID)
+		}
+		return ids, w.Header().Get("X-Last-ID")
+	}
+	now := time.Now()
+	mustInsert(t, db, log{ts: now, content: "one"}, log{ts: now, content: "two"})
+	ids, last := fetch("0")
+	if !reflect.DeepEqual(ids, []int64{1, 2}) || last != "2" {
+		t.Errorf("first export: got %v and last id %s, want [1 2] and 2", ids, last)
+	}
+	mustInsert(t, db, log{ts: now, content: "three"})
+	ids, last = fetch(last)
+	if !reflect.DeepEqual(ids, []int64{3}) || last != "3" {
+		t.Errorf("second export: got %v and last id %s, want [3] and 3", ids, last)
+	}
+	ids, last = fetch(last)
+	if len(ids) != 0 || last != "3" {
+		t.Errorf("nothing new: got %v and last id %s, want none and 3", ids, last)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of logs included in the feed by default, and at most.
+const (
+	defaultFeedSize = 50
+	maxFeedSize     = 500
+)
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link,omitempty"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+	GUID        rssGUID `xml:"guid"`
+}
+
+type rssGUID struct {
+	Value string `xml:",chardata"`
+	// Set to "false" if Value isn't a URL.
+	IsPermaLink string `xml:"isPermaLink,attr,omitempty"`
+}
+
+// legacyGUID identifies a legacy log, which has no id, by its timestamp and
+// content.
+func legacyGUID(l log) rssGUID {
+	sum := sha256.Sum256([]byte(l.ts.UTC().Format(time.RFC3339Nano) + "\n" + l.content))
+	return rssGUID{Value: "legacy-" + hex.EncodeToString(sum[:16]), IsPermaLink: "false"}
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+// baseURL returns the scheme and host r was made to.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// feedTitle is the first line of content.
+func feedTitle(content string) string {
+	if i := strings.IndexByte(content, '\n'); i >= 0 {
+		content = content[:i]
+	}
+	return strings.TrimSpace(content)
+}
+
+// feedHandler serves the most recent logs in the default stream as RSS. The tag
+// parameter limits them to logs with that tag, and n sets how many are included.
+func feedHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := defaultFeedSize
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 1 || n > maxFeedSize {
+				http.Error(w, fmt.Sprintf("invalid n, must be between 1 and %d", maxFeedSize), http.StatusBadRequest)
+				return
+			}
+		}
+		tag := strings.ToLower(r.URL.Query().Get("tag"))
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		logs, err := fetchLogs(ctx, db, filter{tag: tag, limit: n})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		base := baseURL(r)
+		title := ownerName + "'s Logs"
+		link := base + "/"
+		description := "The most recent logs of " + ownerName + "."
+		if tag != "" {
+			title += " tagged #" + tag
+			link += "?tag=" + url.QueryEscape(tag)
+			description = "The most recent logs of " + ownerName + " tagged #" + tag + "."
+		}
+		feed := rssFeed{
+			Version: "2.0",
+			Channel: rssChannel{
+				Title:       title,
+				Link:        link,
+				Description: description,
+				Items:       make([]rssItem, len(logs)),
+			},
+		}
+		for i, l := range logs {
+			item := rssItem{
+				Title:       feedTitle(l.content),
+				Description: l.content,
+				PubDate:     l.ts.Format(time.RFC1123Z),
+			}
+			if l.id == 0 {
+				// Legacy logs have no permalink.
+				item.GUID = legacyGUID(l)
+			} else {
+				item.Link = fmt.Sprintf("%s/log/%d", base, l.id)
+				item.GUID = rssGUID{Value: item.Link}
+			}
+			feed.Channel.Items[i] = item
+		}
+		w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+		if _, err := w.Write([]byte(xml.Header)); err != nil {
+			slog.Error("Failed to write feed.", "err", err)
+			return
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(feed); err != nil {
+			slog.Error("Failed to write feed.", "err", err)
+			return
+		}
+		slog.Info("Served feed request.")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFeedTitle(t *testing.T) {
+	tests := []struct{ content, want string }{
+		{"one line", "one line"},
+		{"  first line \nsecond line", "first line"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := feedTitle(tt.content); got != tt.want {
+			t.Errorf("feedTitle(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://logs.example.com/feed.xml", nil)
+	if got := baseURL(r); got != "http://logs.example.com" {
+		t.Errorf("got %q", got)
+	}
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if got := baseURL(r); got != "https://logs.example.com" {
+		t.Errorf("behind a TLS proxy: got %q", got)
+	}
+}
+
+func TestFeedHandler(t *testing.T) {
+	db := testDB(t)
+	now := time.Now()
+	mustInsert(t, db,
+		log{ts: now.Add(-2 * time.Minute), content: "first"},
+		log{ts: now.Add(-time.Minute), content: "second <b>"},
+		log{ts: now, content: "third\nwith more"},
+	)
+	w := httptest.NewRecorder()
+	feedHandler(db)(w, httptest.NewRequest("GET", "http://logs.example.com/feed.xml", nil))
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/rss+xml") {
+		t.Errorf("got Content-Type %q", ct)
+	}
+	var feed rssFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+	items := feed.Channel.Items
+	if len(items) != 3 {
+		t.Fatalf("got %d items, want 3", len(items))
+	}
+	if items[0].Title != "third" || items[1].Description != "second <b>" {
+		t.Errorf("got items %+v", items)
+	}
+	if items[0].Link == "" || items[0].GUID.Value != items[0].Link {
+		t.Errorf("got link %q and GUID %q, want the permalink for both", items[0].Link, items[0].GUID.Value)
+	}
+}
+
+func TestLegacyGUID(t *testing.T) {
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := legacyGUID(log{ts: ts, content: "same"})
+	if a.IsPermaLink != "false" || !strings.HasPrefix(a.Value, "legacy-") {
+		t.Errorf("got %+v", a)
+	}
+	if b := legacyGUID(log{ts: ts.In(time.FixedZone("", 3600)), content: "same"}); b != a {
+		t.Errorf("the same log in another timezone got %q, want %q", b.Value, a.Value)
+	}
+	if b := legacyGUID(log{ts: ts, content: "other"}); b == a {
+		t.Error("different logs got the same GUID")
+	}
+	if b := legacyGUID(log{ts: ts.Add(time.Second), content: "same"}); b == a {
+		t.Error("logs at different times got the same GUID")
+	}
+}
+
+func TestFeedHandlerRejectsInvalidN(t *testing.T) {
+	for _, n := range []string{"0", "-1", "ten", strconv.Itoa(maxFeedSize + 1)} {
+		w := httptest.NewRecorder()
+		// n is checked before the database is queried.
+		feedHandler(nil)(w, httptest.NewRequest("GET", "/feed.xml?n="+n, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("n=%s: got status %d, want %d", n, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestFeedHandlerTag(t *testing.T) {
+	db := testDB(t)
+	now := time.Now()
+	mustInsert(t, db,
+		log{ts: now.Add(-3 * time.Minute), content: "first #run"},
+		log{ts: now.Add(-2 * time.Minute), content: "not running"},
+		log{ts: now.Add(-time.Minute), content: "second #Run"},
+		log{ts: now, content: "third #run"},
+	)
+	w := httptest.NewRecorder()
+	feedHandler(db)(w, httptest.NewRequest("GET", "http://logs.example.com/feed.xml?tag=RUN&n=2", nil))
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var feed rssFeed
+	if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, item := range feed.Channel.Items {
+		got = append(got, item.Title)
+	}
+	if want := []string{"third #run", "second #Run"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got items %q, want %q", got, want)
+	}
+	if !strings.HasSuffix(feed.Channel.Title, " tagged #run") || feed.Channel.Link != "http://logs.example.com/?tag=run" {
+		t.Errorf("got title %q and link %q, want them for the tag", feed.Channel.Title, feed.Channel.Link)
+	}
+}
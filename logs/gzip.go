@@ -0,0 +1,168 @@
+package main
+
+import (
+	"compress/gzip"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Responses smaller than this aren't worth compressing, in bytes.
+const minGzipSize = 1024
+
+// compressible reports whether responses of the given content type are worth
+// compressing. Images and archives are usually compressed already.
+func compressible(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case strings.HasPrefix(mt, "text/"):
+		return true
+	case mt == "application/json", mt == "application/x-ndjson", mt == "application/xml", mt == "application/rss+xml":
+		return true
+	}
+	return false
+}
+
+// gzipETag returns the ETag of the gzipped form of a response with the given
+// ETag. The two forms have different bytes, so they can't share a strong ETag.
+func gzipETag(etag string) string {
+	return strings.TrimSuffix(etag, `"`) + `-gzip"`
+}
+
+// gzipWriter holds back the start of a response until it knows whether it's
+// worth compressing: either enough has been written, or the handler is done.
+type gzipWriter struct {
+	http.ResponseWriter
+	gz      *gzip.Writer
+	buf     []byte
+	status  int
+	decided bool
+}
+
+func (gw *gzipWriter) WriteHeader(status int) {
+	if gw.status == 0 {
+		gw.status = status
+	}
+}
+
+func (gw *gzipWriter) Write(b []byte) (int, error) {
+	if gw.status == 0 {
+		gw.status = http.StatusOK
+	}
+	if !gw.decided {
+		gw.buf = append(gw.buf, b...)
+		if len(gw.buf) < minGzipSize {
+			return len(b), nil
+		}
+		if err := gw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if gw.gz != nil {
+		return gw.gz.Write(b)
+	}
+	return gw.ResponseWriter.Write(b)
+}
+
+// decide writes the header and any buffered body, compressing them if large
+// is set and the response is compressible.
+func (gw *gzipWriter) decide(large bool) error {
+	gw.decided = true
+	h := gw.Header()
+	if h.Get("Content-Type") == "" && len(gw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(gw.buf))
+	}
+	if large && gw.status == http.StatusOK && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); etag != "" {
+			h.Set("ETag", gzipETag(etag))
+		}
+		gw.gz = gzip.NewWriter(gw.ResponseWriter)
+	}
+	if gw.status != 0 {
+		gw.ResponseWriter.WriteHeader(gw.status)
+	}
+	if len(gw.buf) == 0 {
+		return nil
+	}
+	buf := gw.buf
+	gw.buf = nil
+	var err error
+	if gw.gz != nil {
+		_, err = gw.gz.Write(buf)
+	} else {
+		_, err = gw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what has been written so far. Streamed responses are assumed
+// to be large, so they're compressed.
+func (gw *gzipWriter) Flush() {
+	if !gw.decided {
+		if err := gw.decide(gw.status != 0); err != nil {
+			slog.Error("Failed to write gzipped response.", "err", err)
+			return
+		}
+	}
+	if gw.gz != nil {
+		gw.gz.Flush()
+	}
+	if f, ok := gw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (gw *gzipWriter) Unwrap() http.ResponseWriter {
+	return gw.ResponseWriter
+}
+
+// close finishes the response once the handler has returned.
+func (gw *gzipWriter) close() error {
+	if !gw.decided {
+		if err := gw.decide(false); err != nil {
+			return err
+		}
+	}
+	if gw.gz != nil {
+		return gw.gz.Close()
+	}
+	return nil
+}
+
+// gzipped compresses responses for clients which accept gzip.
+func gzipped(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w}
+		next(gw, r)
+		if err := gw.close(); err != nil {
+			slog.Error("Failed to write gzipped response.", "err", err)
+		}
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if i := strings.IndexByte(enc, ';'); i >= 0 {
+			if strings.TrimSpace(enc[i+1:]) == "q=0" {
+				continue
+			}
+			enc = strings.TrimSpace(enc[:i])
+		}
+		// Content codings are case-insensitive.
+		if strings.EqualFold(enc, "gzip") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveGzipped serves body as contentType through gzipped, with the given
+// Accept-Encoding.
+func serveGzipped(contentType, body, acceptEncoding string) *httptest.ResponseRecorder {
+	h := gzipped(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("ETag", `"abc"`)
+		io.WriteString(w, body)
+	})
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestGzipped(t *testing.T) {
+	large := strings.Repeat("log ", minGzipSize)
+	w := serveGzipped("text/html; charset=utf-8", large, "gzip, deflate")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("large response wasn't compressed")
+	}
+	if etag := w.Header().Get("ETag"); etag != `"abc-gzip"` {
+		t.Errorf("got ETag %q, want the gzip one", etag)
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(zr); err != nil || string(b) != large {
+		t.Errorf("got %d bytes back, %v, want %d", len(b), err, len(large))
+	}
+
+	for _, tt := range []struct {
+		name, contentType, body, acceptEncoding string
+	}{
+		{"small", "text/html", "hello", "gzip"},
+		{"not accepted", "text/html", large, "identity"},
+		{"refused", "text/html", large, "gzip;q=0"},
+		{"incompressible", "image/png", large, "gzip"},
+	} {
+		w := serveGzipped(tt.contentType, tt.body, tt.acceptEncoding)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.String() != tt.body {
+			t.Errorf("%s: response was compressed", tt.name)
+		}
+		if etag := w.Header().Get("ETag"); etag != `"abc"` {
+			t.Errorf("%s: got ETag %q", tt.name, etag)
+		}
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.8", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"br", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsGzip(r); got != tt.want {
+			t.Errorf("Accept-Encoding %q: got %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
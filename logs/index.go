@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// logView is a log as shown in a list.
+type logView struct {
+	ID      int64 // 0 for legacy logs, which have no permalink.
+	Time    string
+	Author  string
+	Content template.HTML
+}
+
+// newLogView prepares l to be shown, in the given timezone.
+func newLogView(l log, loc *time.Location) logView {
+	content := renderContent(l.content, l.entities)
+	if preview, ok := previewContent(l.content); ok {
+		content = "<details><summary>" + renderContent(preview, l.entities) + "</summary>" + content + "</details>"
+	}
+	if l.deleted {
+		content = "<del>" + content + "</del>"
+	}
+	return logView{
+		ID:     l.id,
+		Time:   l.ts.In(loc).Format(timeFormat),
+		Author: authorName(l),
+		// renderContent escapes the content itself.
+		Content: template.HTML(content),
+	}
+}
+
+// dayView is the logs of one day, split into those shown and those collapsed
+// past PER_DAY_LIMIT.
+type dayView struct {
+	Day         string
+	Shown, Rest []logView
+}
+
+// groupLogs groups logs by day, in the given timezone.
+func groupLogs(logs []log, loc *time.Location) []dayView {
+	var days []dayView
+	for len(logs) > 0 {
+		// Compare full dates, as the same day of different months is
+		// still a different day.
+		day := logDay(logs[0].ts.In(loc))
+		n := 1
+		for n < len(logs) && logDay(logs[n].ts.In(loc)) == day {
+			n++
+		}
+		shown := n
+		if perDayLimit > 0 && n > perDayLimit {
+			shown = perDayLimit
+		}
+		dv := dayView{Day: day}
+		for i, l := range logs[:n] {
+			if i < shown {
+				dv.Shown = append(dv.Shown, newLogView(l, loc))
+			} else {
+				dv.Rest = append(dv.Rest, newLogView(l, loc))
+			}
+		}
+		days = append(days, dv)
+		logs = logs[n:]
+	}
+	return days
+}
+
+// indexView is the data the index template is executed with.
+type indexView struct {
+	Owner  string
+	Stream string // Empty for the default stream.
+	Base   string // The path of the index of the stream.
+	Style  template.CSS
+	TZ     string
+	Tags   []string
+
+	// The filters applied, if any.
+	Query, Tag, Author string
+	From, To           string
+
+	Days      []dayView
+	Count     int
+	Truncated bool // Whether there were more than MaxRender logs.
+	MaxRender int
+	Prev      string // The URL of the previous page, if there is one.
+	Next      string // The URL of the next page, if there is one.
+
+	Words    int
+	AvgWords float64
+	Elapsed  int64 // In milliseconds.
+}
+
+// logsHTML defines the templates shared by every page listing logs: "log"
+// renders a logView, and "days" renders a list of dayViews.
+const logsHTML = `{{define "log"}}<li>{{if .ID}}(<a href="/log/{{.ID}}">{{.Time}}</a>){{else}}({{.Time}}){{end}} {{.Author}}: {{.Content}}</li>
+{{end}}{{define "days"}}<ul>
+{{range .}}<p>{{.Day}}</p>
+{{range .Shown}}{{template "log" .}}{{end}}{{with .Rest}}<details><summary>{{len .}} more</summary>
+<ul>
+{{range .}}{{template "log" .}}{{end}}</ul>
+</details>
+{{end}}{{end}}</ul>
+{{end}}`
+
+// indexHTML is the index page, executed with an indexView.
+const indexHTML = `<html lang="en">
+<head>
+<meta charset="UTF-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1.0" />
+<title>{{.Owner}}'s Logs{{with .Stream}} ({{.}}){{end}}</title>
+<style>{{.Style}}</style>
+</head>
+<body>
+<div style="max-width: 960px; margin: 0 auto;">
+<p><strong>{{.Owner}}'s Logs{{with .Stream}} ({{.}}){{end}}</strong></p>
+<p>Current TZ: {{.TZ}}.</p>
+{{with .Tags}}<p>Tags:{{range .}} <a href="{{$.Base}}?tag={{.}}">#{{.}}</a>{{end}}</p>
+{{end}}{{with .Query}}<p>Showing {{$.Count}} logs matching "{{.}}".</p>
+{{end}}{{with .Tag}}<p>Showing {{$.Count}} logs tagged #{{.}}. <a href="{{$.Base}}">Show all</a>.</p>
+{{end}}{{with .Author}}<p>Showing {{$.Count}} logs by {{.}}. <a href="{{$.Base}}">Show all</a>.</p>
+{{end}}{{if or .From .To}}<p>Showing logs{{with .From}} from {{.}}{{end}}{{with .To}} to {{.}}{{end}}.</p>
+{{end}}{{template "days" .Days}}{{if .Truncated}}<p>Only {{.MaxRender}} logs are shown per page.</p>
+{{end}}{{if or .Prev .Next}}<p style="text-align: center;">
+{{with .Prev}}<a href="{{.}}">Previous</a>
+{{end}}{{with .Next}}<a href="{{.}}">Next</a>
+{{end}}</p>
+{{end}}<p style="text-align: center;">Rendered {{.Count}} logs ({{.Words}} words, {{printf "%.1f" .AvgWords}} per log) in {{.Elapsed}} ms.</p>
+</div>
+</body>
+</html>
+`
+
+// searchView is the data the search template is executed with.
+type searchView struct {
+	Owner     string
+	Style     template.CSS
+	Query     string // Empty if nothing was searched for yet.
+	Days      []dayView
+	Count     int
+	Truncated bool // Whether there were more than MaxRender matches.
+	MaxRender int
+}
+
+// searchHTML is the search page, executed with a searchView.
+const searchHTML = `<html lang="en">
+<head>
+<meta charset="UTF-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1.0" />
+<title>Search {{.Owner}}'s Logs</title>
+<style>{{.Style}}</style>
+</head>
+<body>
+<div style="max-width: 960px; margin: 0 auto;">
+<p><strong><a href="/">{{.Owner}}'s Logs</a></strong></p>
+<form action="/search" method="get">
+<input type="search" name="q" value="{{.Query}}" autofocus />
+<button type="submit">Search</button>
+</form>
+{{with .Query}}<p>Found {{$.Count}} logs matching "{{.}}".</p>
+{{if $.Truncated}}<p>Only the first {{$.MaxRender}} matches are shown.</p>
+{{end}}{{template "days" $.Days}}{{end}}</div>
+</body>
+</html>
+`
+
+// yearView is the logs of one year on the on this day page.
+type yearView struct {
+	Year int
+	Days []dayView
+}
+
+// onThisDayView is the data the on this day template is executed with.
+type onThisDayView struct {
+	Owner string
+	Style template.CSS
+	Years []yearView // Newest first.
+}
+
+// onThisDayHTML is the on this day page, executed with an onThisDayView.
+const onThisDayHTML = `<html lang="en">
+<head>
+<meta charset="UTF-8" />
+<meta name="viewport" content="width=device-width, initial-scale=1.0" />
+<title>On This Day in {{.Owner}}'s Logs</title>
+<style>{{.Style}}</style>
+</head>
+<body>
+<div style="max-width: 960px; margin: 0 auto;">
+<p><strong><a href="/">{{.Owner}}'s Logs</a></strong></p>
+{{range .Years}}<h3>{{.Year}}</h3>
+{{template "days" .Days}}{{else}}<p>Nothing was logged on this day in previous years.</p>
+{{end}}</div>
+</body>
+</html>
+`
+
+// parseTemplates parses the pages listing logs, named "index", "search" and
+// "onthisday". They're parsed once in run.
+func parseTemplates() (*template.Template, error) {
+	tmpl, err := template.New("logs").Parse(logsHTML)
+	if err != nil {
+		return nil, err
+	}
+	for name, text := range map[string]string{"index": indexHTML, "search": searchHTML, "onthisday": onThisDayHTML} {
+		if _, err := tmpl.New(name).Parse(text); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return tmpl, nil
+}
+
+// renderPage writes the template name executed with data as an HTML page,
+// reporting whether it succeeded. It's rendered to a buffer first, so a
+// failure can still be reported to the client.
+func renderPage(w http.ResponseWriter, tmpl *template.Template, name string, data any) bool {
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		slog.Error("Failed to render page.", "template", name, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		slog.Error("Failed to write page.", "template", name, "err", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIndexEscapesContent(t *testing.T) {
+	tmpl, err := parseTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := []log{{id: 1, ts: time.Now(), content: "<b>hi</b>", author: "<i>me</i>"}}
+	w := httptest.NewRecorder()
+	renderPage(w, tmpl, "index", indexView{Owner: "<Jane>", Days: groupLogs(logs, time.UTC)})
+	body := w.Body.String()
+	for _, want := range []string{"&lt;b&gt;hi&lt;/b&gt;", "&lt;i&gt;me&lt;/i&gt;", "&lt;Jane&gt;"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+	for _, bad := range []string{"<b>", "<i>", "<Jane>"} {
+		if strings.Contains(body, bad) {
+			t.Errorf("unescaped %q in:\n%s", bad, body)
+		}
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("got Content-Type %q", ct)
+	}
+}
+
+func TestGroupLogsAcrossMonths(t *testing.T) {
+	setConfig(t, &dayRollover, 0)
+	setConfig(t, &perDayLimit, 0)
+	logs := []log{
+		{ts: time.Date(2024, 6, 3, 12, 0, 0, 0, time.UTC), content: "june"},
+		{ts: time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC), content: "may"},
+		{ts: time.Date(2024, 5, 3, 9, 0, 0, 0, time.UTC), content: "may, earlier"},
+	}
+	days := groupLogs(logs, time.UTC)
+	if len(days) != 2 {
+		t.Fatalf("got %d days, want 2: %+v", len(days), days)
+	}
+	if days[0].Day == days[1].Day || len(days[0].Shown) != 1 || len(days[1].Shown) != 2 {
+		t.Errorf("got %+v", days)
+	}
+}
+
+func TestLogDayRollover(t *testing.T) {
+	setConfig(t, &dayRollover, 4)
+	tests := []struct {
+		ts   time.Time
+		want string
+	}{
+		{time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC), "2024-06-01"},
+		{time.Date(2024, 6, 2, 3, 59, 0, 0, time.UTC), "2024-06-01"},
+		{time.Date(2024, 6, 2, 4, 0, 0, 0, time.UTC), "2024-06-02"},
+		{time.Date(2024, 6, 1, 0, 30, 0, 0, time.UTC), "2024-05-31"},
+	}
+	for _, tt := range tests {
+		if got := logDay(tt.ts); got != tt.want {
+			t.Errorf("logDay(%v) = %q, want %q", tt.ts, got, tt.want)
+		}
+	}
+	setConfig(t, &perDayLimit, 0)
+	days := groupLogs([]log{
+		{ts: time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC), content: "after midnight"},
+		{ts: time.Date(2024, 6, 1, 22, 0, 0, 0, time.UTC), content: "before midnight"},
+	}, time.UTC)
+	if len(days) != 1 || days[0].Day != "2024-06-01" || len(days[0].Shown) != 2 {
+		t.Errorf("got %+v, want both logs on 2024-06-01", days)
+	}
+}
+
+func TestOwnerNameInTitle(t *testing.T) {
+	reloadConfig(t)
+	t.Setenv("OWNER_NAME", " Jane ")
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if ownerName != "Jane" {
+		t.Fatalf("got owner name %q, want %q", ownerName, "Jane")
+	}
+	tmpl, err := parseTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	renderPage(w, tmpl, "index", indexView{Owner: ownerName})
+	body := w.Body.String()
+	for _, want := range []string{"<title>Jane's Logs</title>", "<strong>Jane's Logs</strong>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestFetchOnThisDay(t *testing.T) {
+	db := testDB(t)
+	tz, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustInsert(t, db,
+		// Late in the evening in New York, but the next day in UTC.
+		log{ts: time.Date(2023, 6, 15, 23, 30, 0, 0, tz), content: "last year"},
+		log{ts: time.Date(2022, 6, 15, 8, 0, 0, 0, tz), content: "two years ago"},
+		log{ts: time.Date(2023, 6, 16, 1, 0, 0, 0, tz), content: "the day after"},
+		log{ts: time.Date(2024, 6, 15, 9, 0, 0, 0, tz), content: "this year"},
+		log{ts: time.Date(2023, 6, 15, 12, 0, 0, 0, tz), content: "at work", stream: "work"},
+	)
+	logs, err := fetchOnThisDay(context.Background(), db, tz, time.Date(2024, 6, 15, 12, 0, 0, 0, tz))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, l := range logs {
+		got = append(got, l.content)
+	}
+	if want := []string{"last year", "two years ago"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOnThisDayHandler(t *testing.T) {
+	db := testDB(t)
+	tmpl, err := parseTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := onThisDayHandler(db, time.UTC, tmpl)
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/onthisday", nil))
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "Nothing was logged on this day in previous years.") {
+		t.Errorf("without logs: got status %d:\n%s", w.Code, w.Body)
+	}
+	now := time.Now().UTC()
+	// Four years back, so that today is in that year too even if it's the
+	// 29th of February.
+	mustInsert(t, db, log{ts: now.AddDate(-4, 0, 0), content: "years ago"})
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/onthisday", nil))
+	body := w.Body.String()
+	for _, want := range []string{fmt.Sprintf("<h3>%d</h3>", now.Year()-4), "years ago"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
+
+func TestGroupLogsPerDayLimit(t *testing.T) {
+	setConfig(t, &dayRollover, 0)
+	setConfig(t, &perDayLimit, 2)
+	ts := time.Date(2024, 6, 2, 12, 0, 0, 0, time.UTC)
+	logs := []log{
+		{id: 5, ts: ts, content: "five"},
+		{id: 4, ts: ts.Add(-time.Minute), content: "four"},
+		{id: 3, ts: ts.Add(-2 * time.Minute), content: "three"},
+		{id: 2, ts: ts.AddDate(0, 0, -1), content: "two"},
+	}
+	days := groupLogs(logs, time.UTC)
+	if len(days) != 2 || len(days[0].Shown) != 2 || len(days[0].Rest) != 1 || len(days[1].Shown) != 1 || len(days[1].Rest) != 0 {
+		t.Fatalf("got %+v, want 2 shown and 1 collapsed, then 1 shown", days)
+	}
+	tmpl, err := parseTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	renderPage(w, tmpl, "index", indexView{Owner: "Jane", Days: days})
+	body := w.Body.String()
+	if n := strings.Count(body, "<details><summary>1 more</summary>"); n != 1 {
+		t.Errorf("got %d collapsed sections, want 1:\n%s", n, body)
+	}
+	if i, j := strings.Index(body, "<details>"), strings.Index(body, "three"); i < 0 || j < i {
+		t.Errorf("the third log isn't collapsed:\n%s", body)
+	}
+
+	setConfig(t, &perDayLimit, 0)
+	if days := groupLogs(logs, time.UTC); len(days[0].Shown) != 3 || len(days[0].Rest) != 0 {
+		t.Errorf("without a limit: got %+v, want every log shown", days)
+	}
+}
+
+func TestNewLogViewPreview(t *testing.T) {
+	setConfig(t, &previewLength, 3)
+	v := newLogView(log{ts: time.Now(), content: "日本語 & more"}, time.UTC)
+	if want := "<details><summary>日本語…</summary>日本語 &amp; more</details>"; string(v.Content) != want {
+		t.Errorf("got %q, want %q", v.Content, want)
+	}
+	v = newLogView(log{ts: time.Now(), content: "短い"}, time.UTC)
+	if string(v.Content) != "短い" {
+		t.Errorf("short content: got %q", v.Content)
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	setConfig(t, &dayRollover, 0)
+	setConfig(t, &perDayLimit, 0)
+	setConfig(t, &previewLength, 0)
+	tmpl, err := parseTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2024, 6, 1, 14, 30, 0, 0, time.UTC)
+	days := groupLogs([]log{
+		{id: 7, ts: ts, content: "ran 5k #run", author: "jane"},
+		{ts: ts.AddDate(-3, 0, 0), content: "legacy"},
+	}, time.UTC)
+	tests := []struct {
+		name string
+		data any
+		want []string
+	}{
+		{"index", indexView{
+			Owner: "Jane", Stream: "work", Base: "/work/", TZ: "UTC", Tags: []string{"run"},
+			Tag: "run", Days: days, Count: 2, Truncated: true, MaxRender: 2,
+			Prev: "/work/?offset=0", Next: "/work/?offset=4", Words: 4, AvgWords: 2,
+		}, []string{
+			"<title>Jane's Logs (work)</title>",
+			`<a href="/work/?tag=run">#run</a>`,
+			"Showing 2 logs tagged #run.",
+			"<p>2024-06-01</p>",
+			`<li>(<a href="/log/7">2:30 PM</a>) jane: ran 5k #run</li>`,
+			"<li>(2:30 PM) unknown: legacy</li>",
+			"Only 2 logs are shown per page.",
+			`<a href="/work/?offset=0">Previous</a>`,
+			`<a href="/work/?offset=4">Next</a>`,
+			"Rendered 2 logs (4 words, 2.0 per log)",
+		}},
+		{"search", searchView{Owner: "Jane"}, []string{
+			`<input type="search" name="q" value="" autofocus />`,
+		}},
+		{"search", searchView{Owner: "Jane", Query: `"5k"`, Days: days[:1], Count: 1}, []string{
+			`value="&#34;5k&#34;"`,
+			`Found 1 logs matching "&#34;5k&#34;".`,
+			"jane: ran 5k #run",
+		}},
+		{"onthisday", onThisDayView{Owner: "Jane", Years: []yearView{{Year: 2021, Days: days[1:]}}}, []string{
+			"<h3>2021</h3>",
+			"unknown: legacy",
+		}},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		if !renderPage(w, tmpl, tt.name, tt.data) {
+			t.Fatalf("%s: failed to render: %s", tt.name, w.Body)
+		}
+		body := w.Body.String()
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: missing %q in:\n%s", tt.name, want, body)
+			}
+		}
+	}
+	w := httptest.NewRecorder()
+	if renderPage(w, tmpl, "missing", nil) || w.Code != http.StatusInternalServerError {
+		t.Errorf("missing template: got status %d, want 500", w.Code)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the request duration histogram buckets, in seconds.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// registry holds the metrics exposed on /metrics.
+type registry struct {
+	mu              sync.Mutex
+	requests        uint64
+	errors          uint64
+	telegramInserts uint64
+	bucketCounts    []uint64 // Non-cumulative, one per durationBuckets.
+	durationSum     float64
+	durationCount   uint64
+}
+
+var metrics = &registry{bucketCounts: make([]uint64, len(durationBuckets))}
+
+// observeRequest records a served request with the given status.
+func (m *registry) observeRequest(status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests++
+	if status >= 500 {
+		m.errors++
+	}
+	secs := d.Seconds()
+	for i, le := range durationBuckets {
+		if secs <= le {
+			m.bucketCounts[i]++
+			break
+		}
+	}
+	m.durationSum += secs
+	m.durationCount++
+}
+
+func (m *registry) observeTelegramInsert() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.telegramInserts++
+}
+
+func metricsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		var total int64
+		if err := db.QueryRowContext(ctx, "SELECT count(*) FROM logs WHERE deleted_at IS NULL").Scan(&total); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		fmt.Fprintln(w, "# HELP http_requests_total Total number of HTTP requests served.")
+		fmt.Fprintln(w, "# TYPE http_requests_total counter")
+		fmt.Fprintf(w, "http_requests_total %d\n", metrics.requests)
+		fmt.Fprintln(w, "# HELP http_errors_total Total number of HTTP requests which failed with a 5xx status.")
+		fmt.Fprintln(w, "# TYPE http_errors_total counter")
+		fmt.Fprintf(w, "http_errors_total %d\n", metrics.errors)
+		fmt.Fprintln(w, "# HELP telegram_inserts_total Total number of logs ingested from Telegram.")
+		fmt.Fprintln(w, "# TYPE telegram_inserts_total counter")
+		fmt.Fprintf(w, "telegram_inserts_total %d\n", metrics.telegramInserts)
+		fmt.Fprintln(w, "# HELP http_request_duration_seconds Duration of HTTP requests.")
+		fmt.Fprintln(w, "# TYPE http_request_duration_seconds histogram")
+		var cumulative uint64
+		for i, le := range durationBuckets {
+			cumulative += metrics.bucketCounts[i]
+			fmt.Fprintf(w, "http_request_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", metrics.durationCount)
+		fmt.Fprintf(w, "http_request_duration_seconds_sum %s\n", strconv.FormatFloat(metrics.durationSum, 'g', -1, 64))
+		fmt.Fprintf(w, "http_request_duration_seconds_count %d\n", metrics.durationCount)
+		fmt.Fprintln(w, "# HELP logs_total Number of logs stored.")
+		fmt.Fprintln(w, "# TYPE logs_total gauge")
+		fmt.Fprintf(w, "logs_total %d\n", total)
+	}
+}
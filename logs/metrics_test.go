@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserveRequest(t *testing.T) {
+	m := &registry{bucketCounts: make([]uint64, len(durationBuckets))}
+	m.observeRequest(200, 3*time.Millisecond)
+	m.observeRequest(500, 30*time.Millisecond)
+	m.observeRequest(200, time.Minute)
+	if m.requests != 3 || m.errors != 1 || m.durationCount != 3 {
+		t.Errorf("got %d requests, %d errors and %d durations, want 3, 1 and 3", m.requests, m.errors, m.durationCount)
+	}
+	// The minute is past the last bucket, so it's only counted in +Inf.
+	if m.bucketCounts[0] != 1 || m.bucketCounts[3] != 1 {
+		t.Errorf("got bucket counts %v", m.bucketCounts)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	db := testDB(t)
+	mustInsert(t, db, log{ts: time.Now(), content: "counted"})
+	w := httptest.NewRecorder()
+	metricsHandler(db)(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"http_requests_total ",
+		"http_errors_total ",
+		"telegram_inserts_total ",
+		`http_request_duration_seconds_bucket{le="+Inf"} `,
+		"http_request_duration_seconds_sum ",
+		"http_request_duration_seconds_count ",
+		"logs_total 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusWriter records the status code written to the underlying writer.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes through, so streamed responses aren't held back.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	streamKey
+)
+
+// requestID returns the id of the request ctx belongs to, or "" if it has
+// none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// validRequestID reports whether an incoming X-Request-ID is safe to reuse,
+// and in particular to write to the logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// withRequestID gives each request an id, taken from its X-Request-ID header
+// if it has a valid one or generated otherwise, and echoes it in the
+// response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			var b [8]byte
+			if _, err := rand.Read(b[:]); err != nil {
+				slog.Error("Failed to generate request id.", "err", err)
+			}
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// logRequests logs the method, path, status and duration of each request, and
+// records them in the request metrics.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		d := time.Since(start)
+		metrics.observeRequest(sw.status, d)
+		slog.Info("Served request.", "method", r.Method, "path", r.URL.Path, "status", sw.status, "duration", d, "request_id", requestID(r.Context()))
+	})
+}
+
+// securityHeaders sets hardening headers on every response.
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("Referrer-Policy", "no-referrer")
+		if contentSecurity != "" {
+			h.Set("Content-Security-Policy", contentSecurity)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// How long clients are asked to wait during maintenance.
+const maintenanceRetryAfter = 5 * time.Minute
+
+// maintenanceMode rejects requests other than health checks while MAINTENANCE
+// is set.
+func maintenanceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !maintenance || r.URL.Path == "/healthz" || r.URL.Path == "/ping" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == "/_wh/telegram" && maintenanceAck {
+			slog.Info("Dropped Telegram update during maintenance.")
+			return
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		printHTMLHead(w, "Down for Maintenance")
+		fmt.Fprintln(w, "<p>Down for maintenance, please try again in a few minutes.</p>")
+		printHTMLFoot(w)
+	})
+}
+
+// webAuthConfigured reports whether the web view requires authentication,
+// without which it's public.
+func webAuthConfigured() bool {
+	return webUser != "" || webPassword != "" || totpKey != nil
+}
+
+// basicAuth requires requests to carry the WEB_USER and WEB_PASSWORD
+// credentials, if they are configured. If TOTP_SECRET is set, a session
+// cookie from entering a code works too, and browsers are asked for a code
+// rather than credentials.
+func basicAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if totpKey != nil && validSession(r, totpKey, time.Now()) {
+			next(w, r)
+			return
+		}
+		if !webAuthConfigured() {
+			next(w, r)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok || (webUser == "" && webPassword == "") ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(webUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(webPassword)) != 1 {
+			if totpKey != nil {
+				// Ask for a code instead, though scripts can still use basic
+				// auth if it's configured.
+				printTOTPForm(w, r.URL.RequestURI(), http.StatusUnauthorized, "")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="logs", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// clientAddr returns the address r came from, without its port. With
+// TRUST_PROXY, that's the last address in X-Forwarded-For, which the proxy
+// appended; any before it were sent by the client, so could be anything.
+// Otherwise, it's the address of the connection, which behind a proxy is the
+// proxy's for every client.
+func clientAddr(r *http.Request) string {
+	if trustProxy {
+		if vs := r.Header.Values("X-Forwarded-For"); len(vs) > 0 {
+			v := vs[len(vs)-1]
+			if addr := strings.TrimSpace(v[strings.LastIndex(v, ",")+1:]); addr != "" {
+				return addr
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimiter is a token bucket which refills continuously.
+type rateLimiter struct {
+	mu     sync.Mutex
+	tokens float64
+	max    float64
+	rate   float64 // Tokens per second.
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute requests per minute,
+// with bursts of up to the same size. If perMinute is 0, nil is returned.
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		tokens: float64(perMinute),
+		max:    float64(perMinute),
+		rate:   float64(perMinute) / 60,
+		last:   time.Now(),
+	}
+}
+
+// allow consumes a token, reporting whether one was available.
+func (rl *rateLimiter) allow() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.max {
+		rl.tokens = rl.max
+	}
+	rl.last = now
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
+
+// rateLimit rejects requests once rl is exhausted. A nil rl allows everything.
+func rateLimit(rl *rateLimiter, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rl != nil && !rl.allow() {
+			slog.Info("Rate limit exceeded.")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// validBearerToken reports whether r is authorized by token. An empty token
+// authorizes nothing.
+func validBearerToken(r *http.Request, token string) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) == 1
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLogRequestsRecordsStatus(t *testing.T) {
+	var status int
+	h := logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+		status = w.(*statusWriter).status
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+	if w.Code != http.StatusNotFound || status != http.StatusNotFound {
+		t.Errorf("got status %d, recorded %d, want %d", w.Code, status, http.StatusNotFound)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	ok := basicAuth(func(w http.ResponseWriter, r *http.Request) {})
+	serve := func(user, pass string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		if user != "" || pass != "" {
+			r.SetBasicAuth(user, pass)
+		}
+		w := httptest.NewRecorder()
+		ok(w, r)
+		return w
+	}
+
+	setConfig(t, &totpKey, nil)
+	setConfig(t, &webUser, "")
+	setConfig(t, &webPassword, "")
+	if w := serve("", ""); w.Code != http.StatusOK {
+		t.Errorf("without auth configured: got status %d, want 200", w.Code)
+	}
+
+	webUser, webPassword = "me", "hunter2"
+	tests := []struct {
+		user, pass string
+		want       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"me", "wrong", http.StatusUnauthorized},
+		{"you", "hunter2", http.StatusUnauthorized},
+		{"me", "hunter2", http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := serve(tt.user, tt.pass)
+		if w.Code != tt.want {
+			t.Errorf("%q:%q: got status %d, want %d", tt.user, tt.pass, w.Code, tt.want)
+		}
+		if tt.want == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%q:%q: no WWW-Authenticate header", tt.user, tt.pass)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	h := rateLimit(newRateLimiter(3), func(w http.ResponseWriter, r *http.Request) {})
+	var limited int
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/_wh/telegram", nil))
+		if w.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 7 {
+		t.Errorf("got %d requests limited, want 7", limited)
+	}
+}
+
+func TestRateLimitDisabled(t *testing.T) {
+	if rl := newRateLimiter(0); rl != nil {
+		t.Fatalf("newRateLimiter(0) = %v, want nil", rl)
+	}
+	h := rateLimit(nil, func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/_wh/telegram", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want 200", w.Code)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	setConfig(t, &contentSecurity, "default-src 'none'")
+	w := httptest.NewRecorder()
+	securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	for k, want := range map[string]string{
+		"X-Content-Type-Options":  "nosniff",
+		"X-Frame-Options":         "DENY",
+		"Referrer-Policy":         "no-referrer",
+		"Content-Security-Policy": "default-src 'none'",
+	} {
+		if got := w.Header().Get(k); got != want {
+			t.Errorf("got %s %q, want %q", k, got, want)
+		}
+	}
+
+	contentSecurity = ""
+	w = httptest.NewRecorder()
+	securityHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if _, ok := w.Header()["Content-Security-Policy"]; ok {
+		t.Error("got a Content-Security-Policy with CONTENT_SECURITY_POLICY empty")
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	tests := []struct {
+		trust     bool
+		forwarded []string
+		want      string
+	}{
+		{false, nil, "192.0.2.1"},
+		// Without TRUST_PROXY, the header could have come from anyone.
+		{false, []string{"198.51.100.7"}, "192.0.2.1"},
+		{true, nil, "192.0.2.1"},
+		{true, []string{"198.51.100.7"}, "198.51.100.7"},
+		// Only the last address is the proxy's.
+		{true, []string{"203.0.113.9, 198.51.100.7"}, "198.51.100.7"},
+		{true, []string{"203.0.113.9", "198.51.100.7"}, "198.51.100.7"},
+		{true, []string{" "}, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		setConfig(t, &trustProxy, tt.trust)
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := clientAddr(r); got != tt.want {
+			t.Errorf("trust %v, X-Forwarded-For %q: got %q, want %q", tt.trust, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	h := maintenanceMode(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	setConfig(t, &maintenance, false)
+	if w := serve("/"); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("disabled: got status %d: %s", w.Code, w.Body)
+	}
+
+	maintenance = true
+	setConfig(t, &maintenanceAck, true)
+	w := serve("/")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "300" {
+		t.Errorf("enabled: got status %d with Retry-After %q, want 503 and 300", w.Code, w.Header().Get("Retry-After"))
+	}
+	for _, path := range []string{"/healthz", "/ping"} {
+		if w := serve(path); w.Code != http.StatusOK || w.Body.String() != "ok" {
+			t.Errorf("enabled: %s got status %d, want it served", path, w.Code)
+		}
+	}
+	if w := serve("/_wh/telegram"); w.Code != http.StatusOK || w.Body.String() != "" {
+		t.Errorf("enabled: webhook got status %d: %q, want it acknowledged and dropped", w.Code, w.Body)
+	}
+	maintenanceAck = false
+	if w := serve("/_wh/telegram"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("enabled without ack: webhook got status %d, want 503", w.Code)
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	var got string
+	h := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requestID(r.Context())
+	}))
+	serve := func(id string) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if id != "" {
+			r.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if echoed := w.Header().Get("X-Request-ID"); echoed != got {
+			t.Errorf("echoed %q, but the context has %q", echoed, got)
+		}
+		return got
+	}
+	if id := serve("abc-123"); id != "abc-123" {
+		t.Errorf("got %q, want the incoming id preserved", id)
+	}
+	first, second := serve(""), serve("")
+	if len(first) != 16 || first == second {
+		t.Errorf("got generated ids %q and %q, want distinct 16 character ids", first, second)
+	}
+	if id := serve("bad\x01id"); id == "bad\x01id" || len(id) != 16 {
+		t.Errorf("got %q, want an invalid id replaced", id)
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"abc-123", true},
+		{"f81d4fae-7dec-11d0-a765-00a0c91e6bf6", true},
+		{"", false},
+		{"has space", false},
+		{"line\nbreak", false},
+		{"café", false},
+		{strings.Repeat("a", 128), true},
+		{strings.Repeat("a", 129), false},
+	}
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+	if id := requestID(context.Background()); id != "" {
+		t.Errorf("got %q without a request id, want empty", id)
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	t.Setenv("LOG_FORMAT", "json")
+	if err := configureLogging(&buf); err != nil {
+		t.Fatal(err)
+	}
+	slog.Info("Ingested log.", "source", "message", "bytes", 5)
+	var entry map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("got invalid JSON %q: %v", buf.String(), err)
+	}
+	for key, want := range map[string]any{"level": "INFO", "msg": "Ingested log.", "source": "message", "bytes": 5.0} {
+		if entry[key] != want {
+			t.Errorf("got %s %v, want %v", key, entry[key], want)
+		}
+	}
+	if _, ok := entry["time"]; !ok {
+		t.Errorf("missing time in %q", buf.String())
+	}
+
+	t.Setenv("LOG_FORMAT", "xml")
+	if err := configureLogging(&buf); err == nil {
+		t.Error("got no error for an unknown format")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// pruneLogs permanently deletes the logs made before cutoff, returning how
+// many there were.
+func pruneLogs(ctx context.Context, db *sql.DB, cutoff time.Time) (int64, error) {
+	res, err := db.ExecContext(ctx, "DELETE FROM logs WHERE timestamp < $1", cutoff.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		invalidateCache()
+	}
+	return n, nil
+}
+
+// startPruning deletes logs older than RETENTION_DAYS every RETENTION_INTERVAL
+// until ctx is done, after which the returned channel is closed. If
+// RETENTION_DAYS is unset or 0, logs are kept forever and nothing is started.
+func startPruning(ctx context.Context, db *sql.DB) (<-chan struct{}, error) {
+	done := make(chan struct{})
+	days, err := fallbackInt("RETENTION_DAYS", 0)
+	if err != nil {
+		return nil, err
+	} else if days < 0 {
+		return nil, fmt.Errorf("invalid RETENTION_DAYS %d, must be a positive number of days", days)
+	} else if days == 0 {
+		close(done)
+		return done, nil
+	}
+	interval, err := fallbackDuration("RETENTION_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	} else if interval == 0 {
+		return nil, errors.New("invalid RETENTION_INTERVAL, must be positive")
+	}
+	slog.Info("Pruning old logs.", "retention_days", days, "interval", interval)
+	go func() {
+		defer close(done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			pctx, cancel := context.WithTimeout(ctx, queryTimeout)
+			n, err := pruneLogs(pctx, db, time.Now().AddDate(0, 0, -days))
+			cancel()
+			if err != nil {
+				slog.Error("Failed to prune old logs.", "err", err)
+			} else {
+				slog.Info("Pruned old logs.", "count", n)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return done, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStartPruningConfig(t *testing.T) {
+	t.Setenv("RETENTION_DAYS", "")
+	os.Unsetenv("RETENTION_DAYS")
+	// Nothing is pruned, so no database is needed.
+	done, err := startPruning(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("without RETENTION_DAYS: got a running pruner")
+	}
+	for _, tt := range []struct{ days, interval string }{
+		{"-1", "1h"},
+		{"thirty", "1h"},
+		{"30", "0s"},
+		{"30", "-1h"},
+		{"30", "hourly"},
+	} {
+		t.Setenv("RETENTION_DAYS", tt.days)
+		t.Setenv("RETENTION_INTERVAL", tt.interval)
+		if _, err := startPruning(context.Background(), nil); err == nil {
+			t.Errorf("RETENTION_DAYS=%s RETENTION_INTERVAL=%s: got no error", tt.days, tt.interval)
+		}
+	}
+}
+
+func TestStartPruning(t *testing.T) {
+	db := testDB(t)
+	now := time.Now()
+	mustInsert(t, db,
+		log{ts: now.AddDate(0, 0, -31), content: "old"},
+		log{ts: now.AddDate(0, 0, -29), content: "recent"},
+	)
+	t.Setenv("RETENTION_DAYS", "30")
+	t.Setenv("RETENTION_INTERVAL", "1h")
+	ctx, cancel := context.WithCancel(context.Background())
+	done, err := startPruning(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first prune happens right away.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		logs, err := fetchLogs(context.Background(), db, filter{includeDeleted: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logs) == 1 {
+			if logs[0].content != "recent" {
+				t.Errorf("got %q kept, want the recent log", logs[0].content)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d logs after pruning, want 1", len(logs))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("the pruner didn't stop")
+	}
+}
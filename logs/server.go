@@ -2,23 +2,38 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	logger "log"
+	"html"
+	"html/template"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
-func must(key string) string {
+func must(key string) (string, error) {
 	if v, ok := os.LookupEnv(key); ok {
-		return v
+		return v, nil
 	}
-	panic("missing environment variable " + key)
+	return "", fmt.Errorf("missing environment variable %s", key)
 }
 
 func fallback(key, fv string) string {
@@ -28,75 +43,777 @@ func fallback(key, fv string) string {
 	return fv
 }
 
-// Initialized below.
+// fallbackInt is like fallback, but parses the value as an integer.
+func fallbackInt(key string, fv int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fv, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q for %s", v, key)
+	}
+	return i, nil
+}
+
+// fallbackDuration is like fallback, but parses the value as a duration.
+func fallbackDuration(key string, fv time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fv, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q for %s", v, key)
+	}
+	return d, nil
+}
+
+// fallbackBool is like fallback, but parses the value as a boolean.
+func fallbackBool(key string, fv bool) (bool, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return fv, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid boolean %q for %s", v, key)
+	}
+	return b, nil
+}
+
+// Set by loadConfig.
 var (
 	databaseUrl      string
 	lport            string
+	listenAddr       string
+	sqlitePath       string
+	sqlitePoolSize   int
+	tlsCertFile      string
+	tlsKeyFile       string
 	telegramUsername string
 	telegramSecret   string
+	telegramStrict   bool
+	telegramRate     int
+	telegramBotToken string
+	telegramChannels map[int64]bool
 	ownerName        string
 	timezone         string
+	webUser          string
+	webPassword      string
+	trustProxy       bool
+	ingestToken      string
+	adminToken       string
+	maxContentLen    int
+	truncateContent  bool
+	maxRender        int
+	dayRollover      int
+	perDayLimit      int
+	previewLength    int
+	maintenance      bool
+	maintenanceAck   bool
+	contentSecurity  string
+	theme            string
 )
 
-func init() {
+// postgresDSN returns DATABASE_URL or, if it's unset, a URL assembled from
+// PGHOST, PGPORT, PGUSER, PGPASSWORD and PGDATABASE, as some platforms
+// provide.
+func postgresDSN() (string, error) {
+	if v, ok := os.LookupEnv("DATABASE_URL"); ok {
+		return v + "?sslmode=disable", nil
+	}
+	if _, ok := os.LookupEnv("PGHOST"); !ok {
+		return "", errors.New("missing environment variable DATABASE_URL, or PGHOST and friends")
+	}
+	var vs [3]string
+	for i, key := range []string{"PGHOST", "PGDATABASE", "PGUSER"} {
+		v, err := must(key)
+		if err != nil {
+			return "", err
+		}
+		vs[i] = v
+	}
+	host, name, user := vs[0], vs[1], vs[2]
+	u := url.URL{
+		Scheme:   "postgres",
+		Host:     net.JoinHostPort(host, fallback("PGPORT", "5432")),
+		Path:     "/" + name,
+		RawQuery: "sslmode=disable",
+	}
+	if pass, ok := os.LookupEnv("PGPASSWORD"); ok {
+		u.User = url.UserPassword(user, pass)
+	} else {
+		u.User = url.User(user)
+	}
+	return u.String(), nil
+}
+
+// loadConfig sets the configuration variables from the environment, and from
+// .env if there is one, and checks that they're valid.
+func loadConfig() (err error) {
 	_ = godotenv.Load()
-	databaseUrl = must("DATABASE_URL") + "?sslmode=disable"
+	if databaseUrl, err = postgresDSN(); err != nil {
+		return err
+	}
 	lport = fallback("PORT", "8080")
-	telegramUsername = must("TELEGRAM_USERNAME")
-	telegramSecret = must("TELEGRAM_SECRET")
-	ownerName = fallback("OWNER_NAME", "John Doe")
+	// Overrides PORT, e.g. to only listen on 127.0.0.1.
+	listenAddr = fallback("LISTEN_ADDR", ":"+lport)
+	if _, _, err := net.SplitHostPort(listenAddr); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", listenAddr, err)
+	}
+	// If set, logs are also read from this SQLite database. See legacyPool.
+	sqlitePath = fallback("SQLITE_PATH", "")
+	// The number of connections kept open to it.
+	if sqlitePoolSize, err = fallbackInt("SQLITE_POOL_SIZE", 10); err != nil {
+		return err
+	} else if sqlitePoolSize < 1 {
+		return fmt.Errorf("invalid SQLITE_POOL_SIZE %d, must be positive", sqlitePoolSize)
+	}
+	// If both are set, the server serves HTTPS rather than HTTP.
+	tlsCertFile = fallback("TLS_CERT_FILE", "")
+	tlsKeyFile = fallback("TLS_KEY_FILE", "")
+	if telegramUsername, err = must("TELEGRAM_USERNAME"); err != nil {
+		return err
+	}
+	if telegramSecret, err = must("TELEGRAM_SECRET"); err != nil {
+		return err
+	}
+	// If set, only the secret token header is accepted, not the key parameter.
+	if telegramStrict, err = fallbackBool("TELEGRAM_STRICT", false); err != nil {
+		return err
+	}
+	// Maximum webhook requests per minute, or 0 for no limit.
+	if telegramRate, err = fallbackInt("TELEGRAM_RATE_LIMIT", 60); err != nil {
+		return err
+	}
+	// Needed for commands which reply, like /today.
+	telegramBotToken = fallback("TELEGRAM_BOT_TOKEN", "")
+	// Posts in these channels are logged too.
+	if telegramChannels, err = parseChannelIDs(fallback("TELEGRAM_CHANNELS", "")); err != nil {
+		return fmt.Errorf("invalid TELEGRAM_CHANNELS: %w", err)
+	}
+	ownerName = strings.TrimSpace(fallback("OWNER_NAME", "John Doe"))
+	if err := validateOwnerName(); err != nil {
+		return err
+	}
 	timezone = fallback("TIMEZONE", "America/New_York")
+	// If unset, the web view is public.
+	webUser = fallback("WEB_USER", "")
+	webPassword = fallback("WEB_PASSWORD", "")
+	// If set, the web view can be unlocked with a code from an authenticator
+	// app, as well as with WEB_USER and WEB_PASSWORD.
+	if v := fallback("TOTP_SECRET", ""); v != "" {
+		if totpKey, err = parseTOTPSecret(v); err != nil {
+			return fmt.Errorf("invalid TOTP_SECRET: %w", err)
+		}
+	}
+	// Set this when behind a proxy, like on Railway, so clients are told
+	// apart by the address it appends to X-Forwarded-For. See clientAddr.
+	if trustProxy, err = fallbackBool("TRUST_PROXY", false); err != nil {
+		return err
+	}
+	// If unset, the ingest API rejects all requests.
+	ingestToken = fallback("INGEST_TOKEN", "")
+	// If unset, the admin endpoints reject all requests.
+	adminToken = fallback("ADMIN_TOKEN", "")
+	// Longer content is rejected, or truncated if TRUNCATE_CONTENT is set.
+	if maxContentLen, err = fallbackInt("MAX_CONTENT_LENGTH", 8<<10); err != nil {
+		return err
+	} else if maxContentLen < 1 {
+		return fmt.Errorf("invalid MAX_CONTENT_LENGTH %d, must be positive", maxContentLen)
+	}
+	if truncateContent, err = fallbackBool("TRUNCATE_CONTENT", false); err != nil {
+		return err
+	}
+	// The most logs rendered on a single page.
+	if maxRender, err = fallbackInt("MAX_RENDER", 1000); err != nil {
+		return err
+	} else if maxRender < 1 {
+		return fmt.Errorf("invalid MAX_RENDER %d, must be positive", maxRender)
+	}
+	// Logs made before this hour are grouped with the previous day.
+	if dayRollover, err = fallbackInt("DAY_ROLLOVER_HOUR", 0); err != nil {
+		return err
+	} else if dayRollover < 0 || dayRollover > 23 {
+		return fmt.Errorf("invalid DAY_ROLLOVER_HOUR %d, must be between 0 and 23", dayRollover)
+	}
+	// Logs past this many in a day are collapsed, or 0 to show them all.
+	if perDayLimit, err = fallbackInt("PER_DAY_LIMIT", 0); err != nil {
+		return err
+	} else if perDayLimit < 0 {
+		return fmt.Errorf("invalid PER_DAY_LIMIT %d, must not be negative", perDayLimit)
+	}
+	// Longer logs are shown cut short until expanded, or 0 to show them all.
+	if previewLength, err = fallbackInt("PREVIEW_LENGTH", 0); err != nil {
+		return err
+	} else if previewLength < 0 {
+		return fmt.Errorf("invalid PREVIEW_LENGTH %d, must not be negative", previewLength)
+	}
+	// If set, everything but the health checks is unavailable. Telegram
+	// updates are acknowledged so Telegram doesn't keep retrying them, which
+	// drops them, unless MAINTENANCE_ACK_TELEGRAM is unset.
+	if maintenance, err = fallbackBool("MAINTENANCE", false); err != nil {
+		return err
+	}
+	if maintenanceAck, err = fallbackBool("MAINTENANCE_ACK_TELEGRAM", true); err != nil {
+		return err
+	}
+	// One of light, dark or auto, which follows the browser's preference.
+	theme = fallback("THEME", "light")
+	if _, ok := themeStyles[theme]; !ok {
+		return fmt.Errorf("invalid THEME %q, must be light, dark or auto", theme)
+	}
+	// The pages only use inline styles and same-origin forms.
+	contentSecurity = fallback("CONTENT_SECURITY_POLICY", "default-src 'none'; style-src 'unsafe-inline'; img-src 'self'; form-action 'self'; frame-ancestors 'none'")
+	if queryTimeout, err = fallbackDuration("DB_QUERY_TIMEOUT", 5*time.Second); err != nil {
+		return err
+	} else if queryTimeout == 0 {
+		return errors.New("invalid DB_QUERY_TIMEOUT, must be positive")
+	}
+	// Logs in these streams are kept apart from the rest, and served under
+	// their own prefix.
+	if streams, err = parseStreams(fallback("STREAMS", "")); err != nil {
+		return fmt.Errorf("invalid STREAMS: %w", err)
+	}
+	return validateTLSFiles()
 }
 
+var healthcheck = flag.Bool("healthcheck", false, "check that the server running locally is healthy, instead of starting one")
+
 func main() {
+	flag.Parse()
+	if *healthcheck {
+		err := loadConfig()
+		if err == nil {
+			err = checkHealth()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	if err := run(); err != nil {
-		logger.Fatal(err)
+		slog.Error("Failed to run server.", "err", err)
+		os.Exit(1)
 	}
 }
 
+// checkHealth requests /healthz from the server listening on listenAddr, for
+// container health checks which can't rely on curl being installed.
+func checkHealth() error {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", listenAddr, err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	scheme := "http"
+	client := &http.Client{Timeout: 5 * time.Second}
+	if tlsCertFile != "" && tlsKeyFile != "" {
+		// The certificate is for the public name, not localhost.
+		scheme = "https"
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	resp, err := client.Get(scheme + "://" + net.JoinHostPort(host, port) + "/healthz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
 func doPostgresMigrations(conn *sql.DB) error {
-	stmt := `CREATE TABLE IF NOT EXISTS logs (id SERIAL PRIMARY KEY, timestamp TIMESTAMPTZ, content TEXT);`
-	_, err := conn.Exec(stmt)
-	return err
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS logs (id SERIAL PRIMARY KEY, timestamp TIMESTAMPTZ, content TEXT);`,
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS telegram_message_id BIGINT;`,
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS chat_id BIGINT;`,
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS author TEXT;`,
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ NULL;`,
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS entities JSONB;`,
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS source TEXT;`,
+		// NULL for the default stream. See streams.
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS stream TEXT;`,
+		`CREATE INDEX IF NOT EXISTS logs_stream_idx ON logs (stream, timestamp);`,
+		// Telegram may deliver the same message more than once.
+		`CREATE UNIQUE INDEX IF NOT EXISTS logs_telegram_message_idx ON logs (chat_id, telegram_message_id);`,
+		`CREATE TABLE IF NOT EXISTS tags (log_id INTEGER REFERENCES logs (id) ON DELETE CASCADE, tag TEXT, PRIMARY KEY (log_id, tag));`,
+		`CREATE INDEX IF NOT EXISTS tags_tag_idx ON tags (tag);`,
+	}
+	for _, stmt := range stmts {
+		if _, err := conn.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errNoTrigramSearch is returned by doSearchMigrations if pg_trgm isn't
+// installed on the database server.
+var errNoTrigramSearch = errors.New("the pg_trgm extension isn't available")
+
+// doSearchMigrations indexes log content for the ILIKE search on the index
+// page. This needs the pg_trgm extension, which may not be available.
+// Trigrams, unlike SQLite FTS5, keep matching substrings rather than only
+// whole words. Legacy logs are still searched with an unindexed LIKE.
+func doSearchMigrations(conn *sql.DB) error {
+	var available bool
+	if err := conn.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = 'pg_trgm');`).Scan(&available); err != nil {
+		return err
+	}
+	if !available {
+		return errNoTrigramSearch
+	}
+	stmts := []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm;`,
+		`CREATE INDEX IF NOT EXISTS logs_content_trgm_idx ON logs USING gin (content gin_trgm_ops);`,
+	}
+	for _, stmt := range stmts {
+		if _, err := conn.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// retry calls fn until it succeeds, up to attempts times, doubling the delay
+// between attempts starting from backoff. The last error is returned.
+func retry(fn func() error, attempts int, backoff time.Duration) error {
+	var err error
+	for i := 1; ; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if i == attempts {
+			return err
+		}
+		slog.Warn("Attempt failed, retrying.", "attempt", i, "attempts", attempts, "backoff", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// configurePool applies the DB_MAX_OPEN, DB_MAX_IDLE and DB_CONN_LIFETIME
+// environment variables to the connection pool of db.
+func configurePool(db *sql.DB) error {
+	maxOpen, err := fallbackInt("DB_MAX_OPEN", 10)
+	if err != nil {
+		return err
+	} else if maxOpen < 1 {
+		return fmt.Errorf("invalid DB_MAX_OPEN %d, must be positive", maxOpen)
+	}
+	maxIdle, err := fallbackInt("DB_MAX_IDLE", 5)
+	if err != nil {
+		return err
+	} else if maxIdle < 0 || maxIdle > maxOpen {
+		return fmt.Errorf("invalid DB_MAX_IDLE %d, must be between 0 and DB_MAX_OPEN", maxIdle)
+	}
+	lifetime, err := fallbackDuration("DB_CONN_LIFETIME", 30*time.Minute)
+	if err != nil {
+		return err
+	}
+	db.SetMaxOpenConns(maxOpen)
+	db.SetMaxIdleConns(maxIdle)
+	db.SetConnMaxLifetime(lifetime)
+	return nil
+}
+
+// Maximum length of OWNER_NAME, in characters.
+const maxOwnerNameLen = 64
+
+// validateOwnerName checks that OWNER_NAME is fit for display. It's escaped
+// wherever it's rendered, so any characters are allowed.
+func validateOwnerName() error {
+	if ownerName == "" {
+		return errors.New("OWNER_NAME must not be empty")
+	}
+	if n := utf8.RuneCountInString(ownerName); n > maxOwnerNameLen {
+		return fmt.Errorf("OWNER_NAME is %d characters long, the maximum is %d", n, maxOwnerNameLen)
+	}
+	return nil
+}
+
+// configureLogging selects the log format from LOG_FORMAT, either text or
+// json for log aggregators, which is written to w.
+func configureLogging(w io.Writer) error {
+	switch f := fallback("LOG_FORMAT", "text"); f {
+	case "text":
+		// The default handler writes through the log package, as before.
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(w, nil)))
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q, must be text or json", f)
+	}
+	return nil
+}
+
+// loadLocation loads a time zone. TIMEZONE is loaded once, in run, and
+// shared by the handlers; only the ?tz= override is loaded per request.
+var loadLocation = time.LoadLocation
+
 func run() error {
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	if err := configureLogging(os.Stderr); err != nil {
+		return err
+	}
+	// Loaded once and shared by the handlers, rather than per request.
+	tz, err := loadLocation(timezone)
+	if err != nil {
+		return fmt.Errorf("invalid TIMEZONE %q: %w", timezone, err)
+	}
 	db, err := sql.Open("postgres", databaseUrl)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
-	if err := db.Ping(); err != nil {
+	if err := configurePool(db); err != nil {
+		return err
+	}
+	attempts, err := fallbackInt("DB_CONNECT_ATTEMPTS", 5)
+	if err != nil {
+		return err
+	} else if attempts < 1 {
+		return fmt.Errorf("invalid DB_CONNECT_ATTEMPTS %d, must be positive", attempts)
+	}
+	backoff, err := fallbackDuration("DB_CONNECT_BACKOFF", time.Second)
+	if err != nil {
+		return err
+	}
+	if err := retry(db.Ping, attempts, backoff); err != nil {
 		return err
 	}
 	if err := doPostgresMigrations(db); err != nil {
 		return err
 	}
-	http.HandleFunc("/", getHandler(db))
-	http.HandleFunc("/json", jsonHandler(db))
-	http.HandleFunc("/_wh/telegram", telegramHandler(db))
-	return http.ListenAndServe(":"+lport, nil)
+	if err := doSearchMigrations(db); errors.Is(err, errNoTrigramSearch) {
+		// Search still works without the index, it's just slower.
+		slog.Warn("Not indexing logs for search, as pg_trgm isn't available. Searches will scan every log.")
+	} else if err != nil {
+		slog.Warn("Failed to create search index, searches will scan every log.", "err", err)
+	}
+	if sqlitePath != "" {
+		if legacyPool, err = openLegacyPool(sqlitePath, sqlitePoolSize); err != nil {
+			return fmt.Errorf("failed to open sqlite db %q: %w", sqlitePath, err)
+		}
+		defer legacyPool.Close()
+		slog.Info("Also reading logs from SQLite.", "path", sqlitePath)
+	}
+	tmpl, err := parseTemplates()
+	if err != nil {
+		return fmt.Errorf("failed to parse templates: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", basicAuth(gzipped(cached(newPageCache(), getHandler(db, tz, tmpl)))))
+	mux.HandleFunc("/json", basicAuth(gzipped(jsonHandler(db))))
+	mux.HandleFunc("/export.json", basicAuth(gzipped(jsonHandler(db))))
+	mux.HandleFunc("/export.csv", basicAuth(gzipped(csvHandler(db))))
+	mux.HandleFunc("/export.jsonl", basicAuth(gzipped(jsonlHandler(db))))
+	mux.HandleFunc("/export/incremental", basicAuth(gzipped(incrementalHandler(db))))
+	mux.HandleFunc("/search", basicAuth(searchHandler(db, tz, tmpl)))
+	mux.HandleFunc("/stats", basicAuth(statsHandler(db, tz)))
+	mux.HandleFunc("/stats/hours", basicAuth(hoursHandler(db, tz)))
+	mux.HandleFunc("/stats/terms", basicAuth(termsHandler(db)))
+	mux.HandleFunc("/feed.xml", basicAuth(feedHandler(db)))
+	mux.HandleFunc("/log/", basicAuth(permalinkHandler(db, tz)))
+	mux.HandleFunc("/random", basicAuth(randomHandler(db, tz)))
+	mux.HandleFunc("/onthisday", basicAuth(onThisDayHandler(db, tz, tmpl)))
+	mux.HandleFunc("/add", basicAuth(addHandler(db)))
+	mux.HandleFunc("/recent", basicAuth(recentHandler(db, tz)))
+	mux.HandleFunc("/login", loginHandler())
+	mux.HandleFunc("/_wh/telegram", telegramAuth(rateLimit(newRateLimiter(telegramRate), telegramHandler(db, tz))))
+	mux.HandleFunc("/healthz", healthHandler(db))
+	mux.HandleFunc("/ping", pingHandler)
+	mux.HandleFunc("/favicon.ico", faviconHandler)
+	mux.HandleFunc("/metrics", metricsHandler(db))
+	mux.HandleFunc("/api/logs", apiLogsHandler(db))
+	mux.HandleFunc("/api/logs/", apiLogHandler(db))
+	mux.HandleFunc("/api/import", importHandler(db))
+	mux.HandleFunc("/api/count", basicAuth(cached(newPageCache(), countHandler(db, tz))))
+	mux.HandleFunc("/admin/backup", backupHandler())
+	for stream := range streams {
+		prefix := streamPath(stream)
+		for _, path := range []string{"/" + stream, prefix} {
+			if _, pattern := mux.Handler(&http.Request{URL: &url.URL{Path: path}}); pattern != "/" {
+				return fmt.Errorf("invalid STREAMS: %q clashes with %s", stream, pattern)
+			}
+		}
+		mux.HandleFunc(prefix, basicAuth(gzipped(cached(newPageCache(), inStream(stream, getHandler(db, tz, tmpl))))))
+		mux.HandleFunc(prefix+"add", basicAuth(inStream(stream, addHandler(db))))
+	}
+	srv := &http.Server{
+		Addr:    listenAddr,
+		Handler: withRequestID(logRequests(securityHeaders(maintenanceMode(mux)))),
+	}
+	if err := configureTimeouts(srv); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pruned, err := startPruning(ctx, db)
+	if err != nil {
+		cancel()
+		return err
+	}
+	// Wait for any prune in progress before the database is closed.
+	defer func() {
+		cancel()
+		<-pruned
+	}()
+	return serve(srv)
+}
+
+// configureTimeouts applies the HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT and
+// HTTP_IDLE_TIMEOUT environment variables to srv.
+func configureTimeouts(srv *http.Server) (err error) {
+	if srv.ReadTimeout, err = fallbackDuration("HTTP_READ_TIMEOUT", 15*time.Second); err != nil {
+		return err
+	}
+	if srv.WriteTimeout, err = fallbackDuration("HTTP_WRITE_TIMEOUT", 15*time.Second); err != nil {
+		return err
+	}
+	if srv.IdleTimeout, err = fallbackDuration("HTTP_IDLE_TIMEOUT", 60*time.Second); err != nil {
+		return err
+	}
+	return nil
+}
+
+// validateTLSFiles checks that TLS_CERT_FILE and TLS_KEY_FILE are either both
+// unset or both point at existing files.
+func validateTLSFiles() error {
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	for _, f := range []string{tlsCertFile, tlsKeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("invalid TLS file: %w", err)
+		}
+	}
+	return nil
+}
+
+// How long in-flight requests are given to complete on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// serve runs srv until it fails or the process is asked to stop, in which case
+// the server is shut down gracefully.
+func serve(srv *http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	slog.Info("Listening.", "addr", srv.Addr, "tls", tlsCertFile != "")
+	go func() {
+		if tlsCertFile != "" {
+			errc <- srv.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+		} else {
+			errc <- srv.ListenAndServe()
+		}
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("Shutting down.")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
 }
 
 type log struct {
-	ts      time.Time
-	content string
+	id       int64
+	ts       time.Time
+	content  string
+	author   string // Empty for logs predating authorship.
+	deleted  bool
+	entities []entity // Formatting from Telegram, if any.
+
+	// The IDs of the Telegram message and chat this log was created from, or
+	// 0 for logs which didn't come from Telegram.
+	messageID int64
+	chatID    int64
+	source    string // The kind of update, like sourceMessage, if any.
+
+	stream string // The stream the log is in, or "" for the default one.
 }
 
-func fetchLogs(db *sql.DB) ([]log, error) {
-	rows, err := db.Query("SELECT timestamp, content FROM logs ORDER BY timestamp desc")
+// logColumns are the columns read by scanLog, in order.
+const logColumns = "id, timestamp, content, author, deleted_at IS NOT NULL, entities"
+
+// scanLog reads a log from a row selecting logColumns.
+func scanLog(row interface{ Scan(...interface{}) error }) (log, error) {
+	var (
+		l        log
+		author   sql.NullString
+		entities []byte
+		err      error
+	)
+	if err := row.Scan(&l.id, &l.ts, &l.content, &author, &l.deleted, &entities); err != nil {
+		return log{}, err
+	}
+	l.ts = l.ts.UTC()
+	l.author = author.String
+	if l.entities, err = unmarshalEntities(entities); err != nil {
+		return log{}, err
+	}
+	return l, nil
+}
+
+// fetchLog returns the log with the given id, or sql.ErrNoRows if there is no
+// such log or it was deleted.
+func fetchLog(ctx context.Context, db *sql.DB, id int64) (log, error) {
+	return scanLog(db.QueryRowContext(ctx, "SELECT "+logColumns+" FROM logs WHERE id = $1 AND deleted_at IS NULL", id))
+}
+
+// fetchRandomLog returns a random log from the default stream, or
+// sql.ErrNoRows if there are none.
+func fetchRandomLog(ctx context.Context, db *sql.DB) (log, error) {
+	return scanLog(db.QueryRowContext(ctx, "SELECT "+logColumns+" FROM logs WHERE deleted_at IS NULL AND stream IS NULL ORDER BY RANDOM() LIMIT 1"))
+}
+
+// nullInt64 maps zero values to NULL.
+func nullInt64(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: v != 0}
+}
+
+// nullString maps empty strings to NULL.
+func nullString(v string) sql.NullString {
+	return sql.NullString{String: v, Valid: v != ""}
+}
+
+// filter narrows down which logs are returned by fetchLogs.
+// Pages and feeds show one stream, the default one for those not under a
+// stream's path prefix. Exports, the API and stats cover every stream, with
+// allStreams.
+type filter struct {
+	query  string    // If non-empty, only logs containing this are returned.
+	tag    string    // If non-empty, only logs with this tag are returned.
+	stream string    // Only logs in this stream are returned, "" being the default one.
+	author string    // If non-empty, only logs by this author are returned.
+	from   time.Time // If non-zero, only logs at or after this are returned.
+	to     time.Time // If non-zero, only logs at or before this are returned.
+	before time.Time // If non-zero, only logs before this are returned.
+	asc    bool      // If set, logs are returned oldest first.
+	limit  int       // If positive, at most this many logs are returned.
+	offset int
+
+	// With before, logs at exactly before are returned too if their id is
+	// less than this, so that (before, beforeID) is a keyset cursor.
+	beforeID int64
+
+	allStreams     bool // If set, stream is ignored and logs in every stream are returned.
+	includeDeleted bool // If set, deleted logs are returned too.
+}
+
+// Bounds the time spent on the database queries for a single request. Set
+// from DB_QUERY_TIMEOUT by loadConfig.
+var queryTimeout = 5 * time.Second
+
+// queryContext returns the context to run the database queries for r with.
+// The caller must call the returned cancel function once they're done.
+func queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(r.Context(), queryTimeout)
+}
+
+// beforeLog reports whether l comes before the keyset cursor of f, made of
+// f.before and f.beforeID, in newest first order.
+func beforeLog(l log, f filter) bool {
+	return l.ts.Before(f.before) || l.ts.Equal(f.before) && l.id < f.beforeID
+}
+
+// fetchLogs returns the logs matching f, newest first unless f.asc is set.
+func fetchLogs(ctx context.Context, db *sql.DB, f filter) ([]log, error) {
+	if legacyPool != nil {
+		return fetchCombinedLogs(ctx, db, f)
+	}
+	return fetchPostgresLogs(ctx, db, f)
+}
+
+// postgresWhere returns the WHERE clause selecting the logs matching f, if
+// any, along with its arguments. The limit, offset and order are left out.
+func postgresWhere(f filter) (string, []interface{}) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if !f.includeDeleted {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+	switch {
+	case f.allStreams:
+	case f.stream == "":
+		conds = append(conds, "stream IS NULL")
+	default:
+		args = append(args, f.stream)
+		conds = append(conds, fmt.Sprintf("stream = $%d", len(args)))
+	}
+	if f.query != "" {
+		args = append(args, f.query)
+		conds = append(conds, fmt.Sprintf("content ILIKE '%%' || $%d || '%%'", len(args)))
+	}
+	if f.tag != "" {
+		args = append(args, f.tag)
+		conds = append(conds, fmt.Sprintf("id IN (SELECT log_id FROM tags WHERE tag = $%d)", len(args)))
+	}
+	if f.author != "" {
+		args = append(args, f.author)
+		conds = append(conds, fmt.Sprintf("author = $%d", len(args)))
+	}
+	if !f.from.IsZero() {
+		args = append(args, f.from)
+		conds = append(conds, fmt.Sprintf("timestamp >= $%d", len(args)))
+	}
+	if !f.to.IsZero() {
+		args = append(args, f.to)
+		conds = append(conds, fmt.Sprintf("timestamp <= $%d", len(args)))
+	}
+	if !f.before.IsZero() {
+		args = append(args, f.before, f.beforeID)
+		conds = append(conds, fmt.Sprintf("(timestamp, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+	if len(conds) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func fetchPostgresLogs(ctx context.Context, db *sql.DB, f filter) ([]log, error) {
+	where, args := postgresWhere(f)
+	stmt := "SELECT " + logColumns + " FROM logs" + where
+	// Logs at the same time are ordered by id, so that pages don't overlap.
+	if f.asc {
+		stmt += " ORDER BY timestamp asc, id asc"
+	} else {
+		stmt += " ORDER BY timestamp desc, id desc"
+	}
+	if f.limit > 0 {
+		args = append(args, f.limit)
+		stmt += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+	if f.offset > 0 {
+		args = append(args, f.offset)
+		stmt += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+	rows, err := db.QueryContext(ctx, stmt, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	logs := []log{}
 	for rows.Next() {
-		var ts time.Time
-		var content string
-		if err := rows.Scan(&ts, &content); err != nil {
+		l, err := scanLog(rows)
+		if err != nil {
 			return nil, err
 		}
-		logs = append(logs, log{ts: ts, content: content})
+		logs = append(logs, l)
 	}
 	if err := rows.Err(); err != nil {
 		return nil, err
@@ -104,73 +821,675 @@ func fetchLogs(db *sql.DB) ([]log, error) {
 	return logs, nil
 }
 
-func insertLog(db *sql.DB, l log) error {
-	stmt := "INSERT INTO logs (timestamp, content) VALUES ($1, $2)"
-	if _, err := db.Exec(stmt, l.ts, l.content); err != nil {
+var errContentTooLong = errors.New("content too long")
+
+// countLogs returns the number of logs matching f, ignoring its limit and
+// offset.
+func countLogs(ctx context.Context, db *sql.DB, f filter) (int, error) {
+	f.limit, f.offset = 0, 0
+	if legacyPool != nil {
+		// Migrated logs are in both databases, so they have to be merged
+		// to be counted.
+		logs, err := fetchCombinedLogs(ctx, db, f)
+		return len(logs), err
+	}
+	where, args := postgresWhere(f)
+	var n int
+	err := db.QueryRowContext(ctx, "SELECT count(*) FROM logs"+where, args...).Scan(&n)
+	return n, err
+}
+
+// limitContent enforces MAX_CONTENT_LENGTH on content, either by truncating it
+// with an ellipsis or by returning errContentTooLong.
+func limitContent(content string) (string, error) {
+	if len(content) <= maxContentLen {
+		return content, nil
+	}
+	if !truncateContent {
+		return "", errContentTooLong
+	}
+	const ellipsis = "…"
+	n := maxContentLen - len(ellipsis)
+	if n < 0 {
+		n = 0
+	}
+	// Don't cut a multi-byte character in half.
+	for n > 0 && !utf8.RuneStart(content[n]) {
+		n--
+	}
+	return content[:n] + ellipsis, nil
+}
+
+func insertLog(ctx context.Context, db *sql.DB, l log) error {
+	return insertLogs(ctx, db, []log{l})
+}
+
+// insertLogs inserts all of logs, or none of them if any fails. Logs created
+// from a Telegram message which was already ingested are skipped.
+func insertLogs(ctx context.Context, db *sql.DB, logs []log) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt := "INSERT INTO logs (timestamp, content, author, telegram_message_id, chat_id, entities, source, stream) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (chat_id, telegram_message_id) DO NOTHING RETURNING id"
+	for _, l := range logs {
+		entities, err := marshalEntities(l.entities)
+		if err != nil {
+			return err
+		}
+		var id int64
+		// Timestamps are always stored in UTC, and only converted to the
+		// display timezone when rendered.
+		if err := tx.QueryRowContext(ctx, stmt, l.ts.UTC(), l.content, nullString(l.author), nullInt64(l.messageID), nullInt64(l.chatID), entities, nullString(l.source), nullString(l.stream)).Scan(&id); err == sql.ErrNoRows {
+			slog.Info("Skipping duplicate of Telegram message.", "message_id", l.messageID)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := insertTags(ctx, tx, id, extractTags(l.content)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	invalidateCache()
+	return nil
+}
+
+// updateLog replaces the content, entities and stream of the log created from
+// the same Telegram message as l, reporting whether such a log exists. Its
+// timestamp is only replaced if the edit backdated it.
+func updateLog(ctx context.Context, db *sql.DB, l log, backdated bool) (bool, error) {
+	ents, err := marshalEntities(l.entities)
+	if err != nil {
+		return false, err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	stmt := "UPDATE logs SET content = $1, entities = $2, stream = $3, timestamp = COALESCE($4, timestamp) WHERE chat_id = $5 AND telegram_message_id = $6 RETURNING id"
+	ts := sql.NullTime{Time: l.ts.UTC(), Valid: backdated}
+	rows, err := tx.QueryContext(ctx, stmt, l.content, ents, nullString(l.stream), ts, l.chatID, l.messageID)
+	if err != nil {
+		return false, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return false, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	tags := extractTags(l.content)
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tags WHERE log_id = $1", id); err != nil {
+			return false, err
+		}
+		if err := insertTags(ctx, tx, id, tags); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	invalidateCache()
+	return len(ids) > 0, nil
+}
+
+// deleteLatestLog marks the most recently added log as deleted, which isn't
+// the latest by timestamp if it was backdated. Deleted logs are kept so that
+// they can be recovered.
+func deleteLatestLog(ctx context.Context, db *sql.DB) error {
+	stmt := "UPDATE logs SET deleted_at = now() WHERE id = (SELECT id FROM logs WHERE deleted_at IS NULL ORDER BY id DESC LIMIT 1)"
+	if _, err := db.ExecContext(ctx, stmt); err != nil {
 		return err
 	}
+	invalidateCache()
 	return nil
 }
 
+// deleteLog marks the log with the given id as deleted, reporting whether
+// there was such a log which wasn't deleted already.
+func deleteLog(ctx context.Context, db *sql.DB, id int64) (bool, error) {
+	res, err := db.ExecContext(ctx, "UPDATE logs SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n > 0 {
+		invalidateCache()
+	}
+	return n > 0, nil
+}
+
 const (
 	dayFormat  = "2006-01-02"
 	timeFormat = "3:04 PM"
+	fullFormat = "Monday, January 2, 2006 at 3:04 PM MST"
 )
 
-func getHandler(db *sql.DB) http.HandlerFunc {
-	tz, err := time.LoadLocation(timezone)
+const defaultPageLimit = 100
+
+// parsePage reads the limit and offset query parameters from r. The limit is
+// capped at maxRender.
+func parsePage(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return 0, 0, fmt.Errorf("invalid limit %q", v)
+		}
+	}
+	if limit > maxRender {
+		limit = maxRender
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset %q", v)
+		}
+	}
+	return limit, offset, nil
+}
+
+// parseBound parses v as either an RFC3339 timestamp or a date in tz. Dates
+// are taken as the start of the day, or the end of it if end is set.
+func parseBound(v string, tz *time.Location, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(dayFormat, v, tz)
 	if err != nil {
-		panic(err)
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD or RFC3339", v)
+	}
+	if end {
+		// Postgres stores microseconds, so this is the last instant of the day.
+		t = t.AddDate(0, 0, 1).Add(-time.Microsecond)
+	}
+	return t, nil
+}
+
+// parseRange reads the from and to query parameters from r. Either may be
+// zero if the corresponding parameter is absent.
+func parseRange(r *http.Request, tz *time.Location) (from, to time.Time, err error) {
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = parseBound(v, tz, false); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = parseBound(v, tz, true); err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must not be after to")
+	}
+	return from, to, nil
+}
+
+// pageURL returns the URL of r with the offset query parameter replaced.
+func pageURL(r *http.Request, offset int) string {
+	q := r.URL.Query()
+	q.Set("offset", strconv.Itoa(offset))
+	return r.URL.Path + "?" + q.Encode()
+}
+
+const (
+	lightStyle = "body { background: #fff; color: #111; } a { color: #0645ad; }"
+	darkStyle  = "body { background: #121212; color: #ddd; } a { color: #8ab4f8; }"
+)
+
+// themeStyles are the stylesheets for each THEME. They're inlined into every
+// page so that there are no assets to serve.
+var themeStyles = map[string]string{
+	"light": ":root { color-scheme: light; } " + lightStyle,
+	"dark":  ":root { color-scheme: dark; } " + darkStyle,
+	"auto":  ":root { color-scheme: light dark; } " + lightStyle + " @media (prefers-color-scheme: dark) { " + darkStyle + " }",
+}
+
+// printHTMLHead writes the start of an HTML page with the given title, up to
+// and including the opening of the main content container.
+func printHTMLHead(w io.Writer, title string) {
+	fmt.Fprintln(w, `<html lang="en">`)
+	fmt.Fprintln(w, "<head>")
+	fmt.Fprintln(w, `<meta charset="UTF-8" />`)
+	fmt.Fprintln(w, `<meta name="viewport" content="width=device-width, initial-scale=1.0" />`)
+	fmt.Fprintf(w, "<title>%s</title>\n", html.EscapeString(title))
+	fmt.Fprintf(w, "<style>%s</style>\n", themeStyles[theme])
+	fmt.Fprintln(w, "</head>")
+	fmt.Fprintln(w, "<body>")
+	fmt.Fprintln(w, "<div style=\"max-width: 960px; margin: 0 auto;\">")
+}
+
+// printHTMLFoot closes everything opened by printHTMLHead.
+func printHTMLFoot(w io.Writer) {
+	fmt.Fprintln(w, "</div>")
+	fmt.Fprintln(w, "</body>")
+	fmt.Fprintln(w, "</html>")
+}
+
+// authorName is the name displayed as the author of l.
+func authorName(l log) string {
+	if l.author == "" {
+		return "unknown"
+	}
+	return l.author
+}
+
+// logDay returns the day ts is grouped under, which is the previous day for
+// times before DAY_ROLLOVER_HOUR.
+func logDay(ts time.Time) string {
+	return ts.Add(-time.Duration(dayRollover) * time.Hour).Format(dayFormat)
+}
+
+// previewContent returns the first PREVIEW_LENGTH characters of content,
+// and whether that's shorter than content.
+func previewContent(content string) (string, bool) {
+	if previewLength <= 0 || utf8.RuneCountInString(content) <= previewLength {
+		return content, false
+	}
+	// Cut on a rune boundary, so multi-byte characters aren't split.
+	n := 0
+	for i := range content {
+		if n == previewLength {
+			return content[:i] + "…", true
+		}
+		n++
+	}
+	return content, false
+}
+
+// wordStats returns the total number of words in logs, and the average number
+// of words per log.
+func wordStats(logs []log) (total int, avg float64) {
+	for _, l := range logs {
+		total += len(strings.Fields(l.content))
 	}
+	if len(logs) > 0 {
+		avg = float64(total) / float64(len(logs))
+	}
+	return total, avg
+}
+
+// showDeleted reports whether r asks for deleted logs with include_deleted=1,
+// and is allowed to see them. That needs either ADMIN_TOKEN, or the web view
+// to require authentication. Otherwise the parameter is ignored.
+func showDeleted(r *http.Request) bool {
+	if r.URL.Query().Get("include_deleted") != "1" {
+		return false
+	}
+	return webAuthConfigured() || validBearerToken(r, adminToken)
+}
+
+// getHandler serves the index, rendered with the "index" template.
+func getHandler(db *sql.DB, tz *time.Location, tmpl *template.Template) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		// The index is registered at "/", or "/work/" for a stream, which
+		// matches every path below it that isn't handled elsewhere.
+		stream := streamOf(r)
+		if r.URL.Path != streamPath(stream) {
+			http.NotFound(w, r)
+			return
+		}
 		start := time.Now()
-		logs, err := fetchLogs(db)
+		query := r.URL.Query().Get("q")
+		tag := strings.ToLower(r.URL.Query().Get("tag"))
+		author := r.URL.Query().Get("author")
+		limit, offset, err := parsePage(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from, to, err := parseRange(r, tz)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var asc bool
+		switch order := r.URL.Query().Get("order"); order {
+		case "asc":
+			asc = true
+		case "", "desc":
+		default:
+			http.Error(w, fmt.Sprintf("invalid order %q, expected asc or desc", order), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		// Fetch one extra log to find out whether there is a next page.
+		logs, err := fetchLogs(ctx, db, filter{
+			query:  query,
+			tag:    tag,
+			stream: stream,
+			author: author,
+			from:   from,
+			to:     to,
+			asc:    asc,
+			limit:  limit + 1,
+			offset: offset,
+
+			includeDeleted: showDeleted(r),
+		})
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		fmt.Fprintln(w, `<html lang="en">`)
-		fmt.Fprintln(w, "<head>")
-		fmt.Fprintln(w, `<meta charset="UTF-8" />`)
-		fmt.Fprintln(w, `<meta name="viewport" content="width=device-width, initial-scale=1.0" />`)
-		fmt.Fprintf(w, "<title>%s's Logs</title>\n", ownerName)
-		fmt.Fprintln(w, "</head>")
-		fmt.Fprintln(w, "<body>")
-		fmt.Fprintln(w, "<div style=\"max-width: 960px; margin: 0 auto;\">")
-		fmt.Fprintf(w, "<p><strong>%s's Logs</strong></p>\n", ownerName)
-		fmt.Fprintf(w, "<p>Current TZ: %s.</p>\n", timezone)
-		fmt.Fprintln(w, "<ul>")
-		var prevday int
-		for _, l := range logs {
+		tags, err := fetchTags(ctx, db, stream)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hasNext := len(logs) > limit
+		if hasNext {
+			logs = logs[:limit]
+		}
+		loc, locName := tz, timezone
+		if v := r.URL.Query().Get("tz"); v != "" {
+			if l, err := loadLocation(v); err == nil {
+				loc, locName = l, v
+			} else {
+				slog.Warn("Ignoring invalid timezone.", "tz", v, "err", err)
+			}
+		}
+		view := indexView{
+			Owner:     ownerName,
+			Stream:    stream,
+			Base:      streamPath(stream),
+			Style:     template.CSS(themeStyles[theme]),
+			TZ:        locName,
+			Tags:      tags,
+			Query:     query,
+			Tag:       tag,
+			Author:    author,
+			Days:      groupLogs(logs, loc),
+			Count:     len(logs),
+			Truncated: hasNext && limit == maxRender,
+			MaxRender: maxRender,
+		}
+		if !from.IsZero() {
+			view.From = from.In(loc).Format(fullFormat)
+		}
+		if !to.IsZero() {
+			view.To = to.In(loc).Format(fullFormat)
+		}
+		if offset > 0 {
+			prev := offset - limit
+			if prev < 0 {
+				prev = 0
+			}
+			view.Prev = pageURL(r, prev)
+		}
+		if hasNext {
+			view.Next = pageURL(r, offset+limit)
+		}
+		view.Words, view.AvgWords = wordStats(logs)
+		view.Elapsed = time.Since(start).Milliseconds()
+		if !renderPage(w, tmpl, "index", view) {
+			return
+		}
+		slog.Info("Served web request.")
+	}
+}
+
+func searchHandler(db *sql.DB, tz *time.Location, tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("q")
+		view := searchView{
+			Owner:     ownerName,
+			Style:     template.CSS(themeStyles[theme]),
+			Query:     query,
+			MaxRender: maxRender,
+		}
+		if query != "" {
+			var err error
+			ctx, cancel := queryContext(r)
+			defer cancel()
+			logs, err := fetchLogs(ctx, db, filter{query: query, limit: maxRender + 1})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if view.Truncated = len(logs) > maxRender; view.Truncated {
+				logs = logs[:maxRender]
+			}
+			view.Days = groupLogs(logs, tz)
+			view.Count = len(logs)
+		}
+		if !renderPage(w, tmpl, "search", view) {
+			return
+		}
+		slog.Info("Served search request.")
+	}
+}
+
+// addHandler serves a form for adding logs from the browser, and adds the
+// logs it submits. It's only available if the web view requires
+// authentication.
+func addHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Without authentication, anyone could add logs.
+		if !webAuthConfigured() {
+			http.Error(w, "adding logs needs WEB_USER and WEB_PASSWORD, or TOTP_SECRET", http.StatusForbidden)
+			return
+		}
+		stream := streamOf(r)
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			printHTMLHead(w, "Add to "+ownerName+"'s Logs")
+			fmt.Fprintf(w, "<p><strong><a href=\"/\">%s's Logs</a></strong></p>\n", html.EscapeString(ownerName))
+			fmt.Fprintf(w, "<form action=\"%sadd\" method=\"post\">\n", streamPath(stream))
+			fmt.Fprintln(w, `<textarea name="content" rows="4" cols="60" required autofocus></textarea>`)
+			fmt.Fprintln(w, `<button type="submit">Add</button>`)
+			fmt.Fprintln(w, "</form>")
+			printHTMLFoot(w)
+			slog.Info("Served add request.")
+			return
+		case http.MethodPost:
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// Basic auth credentials are sent along with cross-site form posts
+		// too, so make sure the form came from here.
+		if origin := r.Header.Get("Origin"); origin != "" && origin != baseURL(r) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		content := r.PostFormValue("content")
+		if strings.TrimSpace(content) == "" {
+			http.Error(w, "content must not be empty", http.StatusBadRequest)
+			return
+		}
+		content, err := limitContent(content)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		if err := insertLog(ctx, db, log{ts: time.Now(), content: content, author: webUser, stream: stream}); err != nil {
+			slog.Error("Failed to insert new log.", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, streamPath(stream), http.StatusSeeOther)
+		slog.Info("Added log from the web.", "bytes", len(content))
+	}
+}
+
+// printLog writes a single log along with its full date and time.
+func printLog(w io.Writer, l log, tz *time.Location) {
+	fmt.Fprintf(w, "<p><a href=\"/log/%d\">%s</a></p>\n", l.id, html.EscapeString(l.ts.In(tz).Format(fullFormat)))
+	fmt.Fprintf(w, "<p>%s</p>\n", renderContent(l.content, l.entities))
+}
+
+func randomHandler(db *sql.DB, tz *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		l, err := fetchRandomLog(ctx, db)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		printHTMLHead(w, ownerName+"'s Logs")
+		fmt.Fprintf(w, "<p><strong><a href=\"/\">%s's Logs</a></strong></p>\n", html.EscapeString(ownerName))
+		if err == sql.ErrNoRows {
+			fmt.Fprintln(w, "<p>There are no logs yet, check back later!</p>")
+		} else {
+			printLog(w, l, tz)
+			fmt.Fprintln(w, `<p><a href="/random">Another one</a></p>`)
+		}
+		printHTMLFoot(w)
+		slog.Info("Served random request.")
+	}
+}
+
+// fetchOnThisDay returns the logs in the default stream made on the same
+// month and day as now in previous years, in the given timezone, newest first.
+func fetchOnThisDay(ctx context.Context, db *sql.DB, tz *time.Location, now time.Time) ([]log, error) {
+	now = now.In(tz)
+	if legacyPool != nil {
+		// The legacy timestamps can't be converted to tz in SQLite, so
+		// filter every log here instead.
+		all, err := fetchCombinedLogs(ctx, db, filter{})
+		if err != nil {
+			return nil, err
+		}
+		logs := []log{}
+		for _, l := range all {
 			ts := l.ts.In(tz)
-			if day := ts.Day(); day != prevday {
-				fmt.Fprintf(w, "<p>%s</p>\n", ts.Format(dayFormat))
-				prevday = day
+			if ts.Month() == now.Month() && ts.Day() == now.Day() && ts.Year() < now.Year() {
+				logs = append(logs, l)
 			}
-			fmt.Fprintf(w, "<li>(%s) %s</li>\n", ts.Format(timeFormat), l.content)
 		}
-		fmt.Fprintln(w, "</ul>")
-		fmt.Fprintf(w, "<p style=\"text-align: center;\">Rendered %d logs in %d ms.</p>", len(logs), time.Since(start).Milliseconds())
-		fmt.Fprintln(w, "</div>")
-		fmt.Fprintln(w, "</body>")
-		fmt.Fprintln(w, "</html>")
-		w.Header().Set("Content-Type", "text/html")
-		logger.Println("Served web request.")
+		return logs, nil
 	}
+	stmt := "SELECT " + logColumns + " FROM logs WHERE deleted_at IS NULL AND stream IS NULL" +
+		" AND EXTRACT(MONTH FROM timestamp AT TIME ZONE $1) = $2" +
+		" AND EXTRACT(DAY FROM timestamp AT TIME ZONE $1) = $3" +
+		" AND EXTRACT(YEAR FROM timestamp AT TIME ZONE $1) < $4" +
+		" ORDER BY timestamp DESC"
+	rows, err := db.QueryContext(ctx, stmt, tz.String(), int(now.Month()), now.Day(), now.Year())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logs := []log{}
+	for rows.Next() {
+		l, err := scanLog(rows)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// onThisDayHandler shows the logs made on today's date in previous years,
+// grouped by year.
+func onThisDayHandler(db *sql.DB, tz *time.Location, tmpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		logs, err := fetchOnThisDay(ctx, db, tz, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		view := onThisDayView{
+			Owner: ownerName,
+			Style: template.CSS(themeStyles[theme]),
+		}
+		for len(logs) > 0 {
+			year := logs[0].ts.In(tz).Year()
+			n := 1
+			for n < len(logs) && logs[n].ts.In(tz).Year() == year {
+				n++
+			}
+			view.Years = append(view.Years, yearView{Year: year, Days: groupLogs(logs[:n], tz)})
+			logs = logs[n:]
+		}
+		if !renderPage(w, tmpl, "onthisday", view) {
+			return
+		}
+		slog.Info("Served on this day request.")
+	}
+}
+
+func permalinkHandler(db *sql.DB, tz *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/log/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid log id", http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		l, err := fetchLog(ctx, db, id)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		printHTMLHead(w, ownerName+"'s Logs")
+		fmt.Fprintf(w, "<p><strong><a href=\"/\">%s's Logs</a></strong></p>\n", html.EscapeString(ownerName))
+		printLog(w, l, tz)
+		printHTMLFoot(w)
+		slog.Info("Served permalink request.")
+	}
+}
+
+// prettyJSON reports whether r asks for indented JSON with the pretty
+// parameter, as in ?pretty or ?pretty=1.
+func prettyJSON(r *http.Request) bool {
+	vs, ok := r.URL.Query()["pretty"]
+	if !ok {
+		return false
+	}
+	if vs[0] == "" {
+		return true
+	}
+	pretty, err := strconv.ParseBool(vs[0])
+	return err == nil && pretty
 }
 
 func jsonHandler(db *sql.DB) http.HandlerFunc {
 	type log struct {
 		Timestamp time.Time `json:"timestamp"`
 		Content   string    `json:"content"`
+		Stream    string    `json:"stream,omitempty"`
 	}
 	type response struct {
 		Logs []log `json:"logs"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
-		logs, err := fetchLogs(db)
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		logs, err := fetchLogs(ctx, db, filter{allStreams: true})
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 		rbody := response{
@@ -180,58 +1499,114 @@ func jsonHandler(db *sql.DB) http.HandlerFunc {
 			rbody.Logs[i] = log{
 				Timestamp: l.ts,
 				Content:   l.content,
+				Stream:    l.stream,
 			}
 		}
-		if err := json.NewEncoder(w).Encode(rbody); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		if prettyJSON(r) {
+			enc.SetIndent("", "  ")
+		}
+		if err := enc.Encode(rbody); err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		logger.Println("Served API request.")
+		slog.Info("Served API request.")
 	}
 }
 
-func telegramHandler(db *sql.DB) http.HandlerFunc {
-	type chat struct {
-		ID int `json:"id"`
-	}
-	type from struct {
-		ID        int    `json:"id"`
-		IsBot     bool   `json:"is_bot"`
-		FirstName string `json:"first_name"`
-		LastName  string `json:"last_name"`
-		Username  string `json:"username"`
-	}
-	type message struct {
-		Text string `json:"text"`
-		Chat chat   `json:"chat"`
-		From from   `json:"from"`
-	}
-	type webhook struct {
-		Message message `json:"message"`
-	}
+func csvHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if whkeys, ok := r.URL.Query()["key"]; !ok || len(whkeys) == 0 || whkeys[0] != telegramSecret {
-			logger.Println("Invalid key.")
-			http.Error(w, "invalid secret key", http.StatusUnauthorized)
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		logs, err := fetchLogs(ctx, db, filter{allStreams: true})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		var wh webhook
-		if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
-			logger.Println("Failed to decode request from Telegram.")
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="logs.csv"`)
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"timestamp", "content", "stream"}); err != nil {
+			slog.Error("Failed to write CSV export.", "err", err)
 			return
 		}
-		if wh.Message.From.Username != telegramUsername {
-			logger.Printf("Expected username %s, got %s.", telegramUsername, wh.Message.From.Username)
-			// If this message is from an unknown sender, ignore it.
+		for _, l := range logs {
+			if err := cw.Write([]string{l.ts.UTC().Format(time.RFC3339), l.content, l.stream}); err != nil {
+				slog.Error("Failed to write CSV export.", "err", err)
+				return
+			}
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			slog.Error("Failed to write CSV export.", "err", err)
 			return
 		}
-		l := log{ts: time.Now(), content: wh.Message.Text}
-		if err := insertLog(db, l); err != nil {
-			logger.Printf("Failed to insert new log: %v", err)
+		slog.Info("Served CSV export.")
+	}
+}
+
+// Number of logs returned by /recent by default, and at most.
+const (
+	defaultRecent = 10
+	maxRecent     = 100
+)
+
+// recentHandler writes the most recent logs in the default stream as plain
+// text, one per line, for use in terminals and status bars.
+func recentHandler(db *sql.DB, tz *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := defaultRecent
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 1 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		if n > maxRecent {
+			n = maxRecent
+		}
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		logs, err := fetchLogs(ctx, db, filter{limit: n})
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		logger.Println("Ingested log.")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, l := range logs {
+			// Keep multi-line logs on a single line.
+			content := strings.Join(strings.Fields(l.content), " ")
+			fmt.Fprintf(w, "%s %s\n", l.ts.In(tz).Format(time.RFC3339), content)
+		}
+		slog.Info("Served recent request.")
+	}
+}
+
+// faviconHandler tells browsers there's no favicon, and to stop asking for a
+// day.
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pingHandler reports that the process is up, without touching the database,
+// for uptime monitors. /healthz checks the database too.
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprint(w, "pong")
+}
+
+func healthHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		if err := db.PingContext(ctx); err != nil {
+			slog.Error("Health check failed.", "err", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "ok")
 	}
 }
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+	"github.com/lib/pq"
+)
+
+// legacyPool is the SQLite database logs were kept in before the move to
+// Postgres. If set, logs are read from both databases until the migration is
+// complete. It's never written to.
+var legacyPool *sqlitex.Pool
+
+func openLegacyPool(path string, size int) (*sqlitex.Pool, error) {
+	flags := sqlite.SQLITE_OPEN_READONLY | sqlite.SQLITE_OPEN_URI | sqlite.SQLITE_OPEN_NOMUTEX
+	return sqlitex.Open(path, flags, size)
+}
+
+// fetchLegacyLogs returns the logs in the SQLite database matching f, ignoring
+// f.offset. Legacy logs have no id or author.
+func fetchLegacyLogs(ctx context.Context, f filter) ([]log, error) {
+	// Legacy logs have no author, and are all in the default stream.
+	if f.author != "" || f.stream != "" {
+		return []log{}, nil
+	}
+	conn := legacyPool.Get(ctx)
+	if conn == nil {
+		return nil, errors.New("failed to get sqlite conn from pool")
+	}
+	defer legacyPool.Put(conn)
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if f.query != "" {
+		conds = append(conds, "content LIKE '%' || ? || '%'")
+		args = append(args, f.query)
+	}
+	if !f.from.IsZero() {
+		conds = append(conds, "datetime(ts) >= datetime(?)")
+		args = append(args, f.from.UTC().Format(time.RFC3339))
+	}
+	if !f.to.IsZero() {
+		conds = append(conds, "datetime(ts) <= datetime(?)")
+		args = append(args, f.to.UTC().Format(time.RFC3339))
+	}
+	if !f.before.IsZero() {
+		// datetime drops fractions of a second, so the cursor is applied
+		// exactly below.
+		conds = append(conds, "datetime(ts) <= datetime(?)")
+		args = append(args, f.before.UTC().Format(time.RFC3339))
+	}
+	stmt := "SELECT ts, content FROM logs"
+	if len(conds) > 0 {
+		stmt += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if f.asc {
+		stmt += " ORDER BY datetime(ts) ASC"
+	} else {
+		stmt += " ORDER BY datetime(ts) DESC"
+	}
+	// Tags and the cursor are matched below, so all logs need to be read to
+	// apply them.
+	if f.limit > 0 && f.tag == "" && f.before.IsZero() {
+		stmt += " LIMIT ?"
+		args = append(args, f.limit)
+	}
+	logs := []log{}
+	err := sqlitex.Exec(conn, stmt, func(stmt *sqlite.Stmt) error {
+		l, ok := scanLegacyLog(stmt)
+		if !ok {
+			return nil
+		}
+		if f.tag != "" && !hasTag(l.content, f.tag) {
+			return nil
+		}
+		if !f.before.IsZero() && !beforeLog(l, f) {
+			return nil
+		}
+		if f.limit > 0 && len(logs) >= f.limit {
+			return nil
+		}
+		logs = append(logs, l)
+		return nil
+	}, args...)
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// scanLegacyLog reads a log from a row of the legacy database. Some old rows
+// have malformed timestamps, which are skipped with a warning rather than
+// failing the whole read.
+func scanLegacyLog(stmt *sqlite.Stmt) (log, bool) {
+	ts, err := time.Parse(time.RFC3339, stmt.GetText("ts"))
+	if err != nil {
+		slog.Error("Skipping legacy log with invalid timestamp.", "err", err)
+		return log{}, false
+	}
+	return log{ts: ts.UTC(), content: stmt.GetText("content")}, true
+}
+
+// fetchUnmigratedLogs returns the legacy logs which aren't in Postgres too, for
+// counts made in Postgres to add. As in fetchCombinedLogs, a log counts as
+// migrated if Postgres has one with the same time and content.
+func fetchUnmigratedLogs(ctx context.Context, db *sql.DB) ([]log, error) {
+	if legacyPool == nil {
+		return nil, nil
+	}
+	legacy, err := fetchLegacyLogs(ctx, filter{})
+	if err != nil || len(legacy) == 0 {
+		return nil, err
+	}
+	tss := make([]string, len(legacy))
+	contents := make([]string, len(legacy))
+	for i, l := range legacy {
+		tss[i] = l.ts.Format(time.RFC3339Nano)
+		contents[i] = l.content
+	}
+	stmt := `SELECT timestamp, content FROM logs WHERE deleted_at IS NULL
+		AND (timestamp, content) IN (SELECT * FROM unnest($1::timestamptz[], $2::text[]))`
+	rows, err := db.QueryContext(ctx, stmt, pq.Array(tss), pq.Array(contents))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type key struct {
+		ts      int64
+		content string
+	}
+	migrated := map[key]bool{}
+	for rows.Next() {
+		var (
+			ts      time.Time
+			content string
+		)
+		if err := rows.Scan(&ts, &content); err != nil {
+			return nil, err
+		}
+		migrated[key{ts.UnixNano(), content}] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	unmigrated := legacy[:0]
+	for _, l := range legacy {
+		if !migrated[key{l.ts.UnixNano(), l.content}] {
+			unmigrated = append(unmigrated, l)
+		}
+	}
+	return unmigrated, nil
+}
+
+func hasTag(content, tag string) bool {
+	for _, t := range extractTags(content) {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchCombinedLogs returns the logs matching f from both Postgres and the
+// legacy SQLite database, ordered by time. Logs which were already migrated,
+// and so are in both, are only returned once.
+func fetchCombinedLogs(ctx context.Context, db *sql.DB, f filter) ([]log, error) {
+	// The offset applies to the merged logs, so it can't be applied to
+	// either database on its own.
+	pf := f
+	pf.offset = 0
+	if f.limit > 0 {
+		pf.limit = f.limit + f.offset
+	}
+	logs, err := fetchPostgresLogs(ctx, db, pf)
+	if err != nil {
+		return nil, err
+	}
+	legacy, err := fetchLegacyLogs(ctx, pf)
+	if err != nil {
+		return nil, err
+	}
+	type key struct {
+		ts      int64
+		content string
+	}
+	seen := map[key]bool{}
+	for _, l := range logs {
+		seen[key{l.ts.UnixNano(), l.content}] = true
+	}
+	for _, l := range legacy {
+		if !seen[key{l.ts.UnixNano(), l.content}] {
+			logs = append(logs, l)
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool {
+		a, b := logs[i], logs[j]
+		if f.asc {
+			a, b = b, a
+		}
+		// Newest first, with legacy logs, which have no id, last.
+		return a.ts.After(b.ts) || a.ts.Equal(b.ts) && a.id > b.id
+	})
+	if f.offset >= len(logs) {
+		return []log{}, nil
+	}
+	logs = logs[f.offset:]
+	if f.limit > 0 && len(logs) > f.limit {
+		logs = logs[:f.limit]
+	}
+	return logs, nil
+}
+
+// Number of pages copied at a time by backupLegacy, and how long it pauses
+// between them so other connections can get at the database.
+const (
+	backupStepPages = 64
+	backupStepPause = 10 * time.Millisecond
+)
+
+// backupLegacy copies the legacy SQLite database to a new timestamped file
+// next to it, returning the path of the copy.
+func backupLegacy(ctx context.Context) (string, error) {
+	conn := legacyPool.Get(ctx)
+	if conn == nil {
+		return "", errors.New("failed to get sqlite conn from pool")
+	}
+	defer legacyPool.Put(conn)
+	name := "logs-" + time.Now().UTC().Format("20060102T150405Z") + ".db"
+	path := filepath.Join(filepath.Dir(sqlitePath), name)
+	dst, err := sqlite.OpenConn(path, sqlite.SQLITE_OPEN_READWRITE|sqlite.SQLITE_OPEN_CREATE)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+	b, err := conn.BackupInit("", "", dst)
+	if err != nil {
+		return "", err
+	}
+	// Copying in steps releases the source database's lock in between.
+	for {
+		if err := b.Step(backupStepPages); err != nil {
+			if code := sqlite.ErrCode(err); code != sqlite.SQLITE_BUSY && code != sqlite.SQLITE_LOCKED {
+				b.Finish()
+				return "", err
+			}
+		} else if b.Remaining() == 0 {
+			break
+		}
+		time.Sleep(backupStepPause)
+	}
+	return path, b.Finish()
+}
+
+func backupHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if !validBearerToken(r, adminToken) {
+			writeJSONError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if legacyPool == nil {
+			writeJSONError(w, http.StatusNotFound, "no sqlite database configured")
+			return
+		}
+		path, err := backupLegacy(r.Context())
+		if err != nil {
+			slog.Error("Failed to back up sqlite db.", "err", err)
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Path string `json:"path"`
+		}{path}); err != nil {
+			slog.Error("Failed to write response.", "err", err)
+			return
+		}
+		slog.Info("Backed up sqlite db.", "path", path)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// testLegacyPool creates a legacy SQLite database holding rows of timestamps
+// and content, and reads from it as legacyPool for the rest of the test.
+func testLegacyPool(t *testing.T, rows ...[2]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mglogs.db")
+	conn, err := sqlite.OpenConn(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := sqlitex.Exec(conn, "CREATE TABLE logs (ts TEXT, content TEXT);", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := sqlitex.Exec(conn, "INSERT INTO logs (ts, content) VALUES (?, ?);", nil, row[0], row[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool, err := openLegacyPool(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pool.Close() })
+	setConfig(t, &legacyPool, pool)
+	return path
+}
+
+func TestFetchLegacyLogs(t *testing.T) {
+	testLegacyPool(t,
+		[2]string{"2020-01-01T00:00:00Z", "first coffee"},
+		[2]string{"2020-01-03T00:00:00Z", "third #tagged"},
+		[2]string{"2020-01-02T00:00:00Z", "second coffee"},
+	)
+	tests := []struct {
+		name string
+		f    filter
+		want []string
+	}{
+		{"all", filter{}, []string{"third #tagged", "second coffee", "first coffee"}},
+		{"asc", filter{asc: true}, []string{"first coffee", "second coffee", "third #tagged"}},
+		{"limit", filter{limit: 1}, []string{"third #tagged"}},
+		{"query", filter{query: "coffee"}, []string{"second coffee", "first coffee"}},
+		{"tag", filter{tag: "tagged"}, []string{"third #tagged"}},
+		{"from", filter{from: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}, []string{"third #tagged", "second coffee"}},
+		{"author", filter{author: "alice"}, nil},
+		{"stream", filter{stream: "work"}, nil},
+	}
+	for _, tt := range tests {
+		logs, err := fetchLegacyLogs(context.Background(), tt.f)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, l := range logs {
+			got = append(got, l.content)
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestFetchCombinedLogs(t *testing.T) {
+	db := testDB(t)
+	testLegacyPool(t,
+		[2]string{"2020-01-01T00:00:00Z", "only in sqlite"},
+		[2]string{"2020-01-02T00:00:00Z", "migrated"},
+	)
+	mustInsert(t, db,
+		log{ts: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), content: "migrated"},
+		log{ts: time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC), content: "only in postgres"},
+	)
+	logs, err := fetchCombinedLogs(context.Background(), db, filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"only in postgres", "migrated", "only in sqlite"}
+	if len(logs) != len(want) {
+		t.Fatalf("got %+v, want %q", logs, want)
+	}
+	for i, l := range logs {
+		if l.content != want[i] {
+			t.Errorf("log %d: got %q, want %q", i, l.content, want[i])
+		}
+	}
+	// The migrated log is the one from Postgres, with its permalink.
+	if logs[1].id == 0 {
+		t.Error("got the legacy copy of the migrated log")
+	}
+}
+
+// postBackup requests a backup from backupHandler with the given token.
+func postBackup(token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/admin/backup", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	backupHandler()(w, r)
+	return w
+}
+
+func TestBackupHandler(t *testing.T) {
+	path := testLegacyPool(t,
+		[2]string{"2020-01-01T00:00:00Z", "one"},
+		[2]string{"2020-01-02T00:00:00Z", "two"},
+	)
+	setConfig(t, &sqlitePath, path)
+	setConfig(t, &adminToken, "admin")
+	if w := postBackup("wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("with a wrong token: got status %d, want 401", w.Code)
+	}
+	w := postBackup("admin")
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Path string `json:"path"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(resp.Path) != filepath.Dir(path) {
+		t.Errorf("got backup at %q, want it next to %q", resp.Path, path)
+	}
+	conn, err := sqlite.OpenConn(resp.Path, sqlite.SQLITE_OPEN_READONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var n int
+	err = sqlitex.Exec(conn, "SELECT count(*) FROM logs;", func(stmt *sqlite.Stmt) error {
+		n = stmt.ColumnInt(0)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("got %d logs in the backup, want 2", n)
+	}
+}
+
+func TestBackupHandlerWithoutSQLite(t *testing.T) {
+	setConfig(t, &legacyPool, nil)
+	setConfig(t, &adminToken, "admin")
+	if w := postBackup("admin"); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want 404", w.Code)
+	}
+}
+
+func TestFetchLegacyLogsCursor(t *testing.T) {
+	testLegacyPool(t,
+		[2]string{"2020-01-01T00:00:00Z", "first"},
+		[2]string{"2020-01-02T00:00:00Z", "second"},
+		[2]string{"2020-01-03T00:00:00Z", "third"},
+	)
+	// Legacy logs have no id, so every one at the cursor's time comes
+	// before it if it has an id.
+	f := filter{before: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), beforeID: 1, limit: 1}
+	logs, err := fetchLegacyLogs(context.Background(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].content != "second" {
+		t.Errorf("got %+v, want the second log", logs)
+	}
+	f.beforeID = 0
+	if logs, err = fetchLegacyLogs(context.Background(), f); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].content != "first" {
+		t.Errorf("with a bare timestamp: got %+v, want the first log", logs)
+	}
+}
+
+func TestFetchLegacyLogsSkipsInvalidTimestamps(t *testing.T) {
+	testLegacyPool(t,
+		[2]string{"2020-01-01T00:00:00Z", "first"},
+		[2]string{"2020-01-02 00:00", "malformed"},
+		[2]string{"2020-01-03T00:00:00Z", "third"},
+	)
+	logs, err := fetchLegacyLogs(context.Background(), filter{asc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].content != "first" || logs[1].content != "third" {
+		t.Errorf("got %+v, want the logs with valid timestamps", logs)
+	}
+}
+
+func TestOpenLegacyPoolSize(t *testing.T) {
+	path := testLegacyPool(t)
+	pool, err := openLegacyPool(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	conn := pool.Get(context.Background())
+	if conn == nil {
+		t.Fatal("got no conn")
+	}
+	defer pool.Put(conn)
+	// The only conn is taken, so this waits until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if conn := pool.Get(ctx); conn != nil {
+		pool.Put(conn)
+		t.Error("got a second conn from a pool of one")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+type dayCount struct {
+	day   time.Time
+	count int
+}
+
+// countLogsByDay returns the number of logs on each day, most recent first,
+// where days are bucketed in the given timezone. Logs in every stream are
+// counted, and so are legacy logs.
+func countLogsByDay(ctx context.Context, db *sql.DB, tz *time.Location) ([]dayCount, error) {
+	stmt := "SELECT date(timestamp AT TIME ZONE $1) AS day, count(*) FROM logs WHERE deleted_at IS NULL GROUP BY day ORDER BY day DESC"
+	rows, err := db.QueryContext(ctx, stmt, tz.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []dayCount{}
+	for rows.Next() {
+		var dc dayCount
+		if err := rows.Scan(&dc.day, &dc.count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, dc)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	legacy, err := fetchUnmigratedLogs(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return addDayCounts(counts, legacy, tz), nil
+}
+
+// addDayCounts adds logs to counts, which is most recent first, as
+// countLogsByDay returns it.
+func addDayCounts(counts []dayCount, logs []log, tz *time.Location) []dayCount {
+	if len(logs) == 0 {
+		return counts
+	}
+	// Postgres and the logs may not agree on the location of a date, so
+	// they're compared by their year, month and day.
+	date := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	byDay := map[time.Time]int{}
+	for _, dc := range counts {
+		byDay[date(dc.day)] += dc.count
+	}
+	for _, l := range logs {
+		byDay[date(l.ts.In(tz))]++
+	}
+	counts = make([]dayCount, 0, len(byDay))
+	for day, count := range byDay {
+		counts = append(counts, dayCount{day, count})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].day.After(counts[j].day) })
+	return counts
+}
+
+func statsHandler(db *sql.DB, tz *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		counts, err := countLogsByDay(ctx, db, tz)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		printHTMLHead(w, ownerName+"'s Stats")
+		fmt.Fprintf(w, "<p><strong>%s's Stats</strong></p>\n", html.EscapeString(ownerName))
+		fmt.Fprintf(w, "<p>Logs per day in %s.</p>\n", html.EscapeString(tz.String()))
+		fmt.Fprintln(w, "<table>")
+		fmt.Fprintln(w, "<tr><th>Date</th><th>Logs</th></tr>")
+		for _, dc := range counts {
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td></tr>\n", dc.day.Format(dayFormat), dc.count)
+		}
+		fmt.Fprintln(w, "</table>")
+		printHTMLFoot(w)
+		slog.Info("Served stats request.")
+	}
+}
+
+// countLogsByHour returns the number of logs made in each hour of the day, in
+// the given timezone. Like countLogsByDay, it counts logs in every stream and
+// legacy logs.
+func countLogsByHour(ctx context.Context, db *sql.DB, tz *time.Location) ([24]int, error) {
+	var counts [24]int
+	stmt := "SELECT EXTRACT(HOUR FROM timestamp AT TIME ZONE $1)::int AS hour, count(*) FROM logs WHERE deleted_at IS NULL GROUP BY hour"
+	rows, err := db.QueryContext(ctx, stmt, tz.String())
+	if err != nil {
+		return counts, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hour, count int
+		if err := rows.Scan(&hour, &count); err != nil {
+			return counts, err
+		}
+		if hour >= 0 && hour < len(counts) {
+			counts[hour] = count
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return counts, err
+	}
+	legacy, err := fetchUnmigratedLogs(ctx, db)
+	if err != nil {
+		return counts, err
+	}
+	addHourCounts(&counts, legacy, tz)
+	return counts, nil
+}
+
+// addHourCounts adds logs to counts by their hour of the day in tz.
+func addHourCounts(counts *[24]int, logs []log, tz *time.Location) {
+	for _, l := range logs {
+		counts[l.ts.In(tz).Hour()]++
+	}
+}
+
+// Width of the longest bar on the hours page, in characters.
+const maxBarWidth = 40
+
+func hoursHandler(db *sql.DB, tz *time.Location) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		counts, err := countLogsByHour(ctx, db, tz)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var max int
+		for _, c := range counts {
+			if c > max {
+				max = c
+			}
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		printHTMLHead(w, ownerName+"'s Stats")
+		fmt.Fprintf(w, "<p><strong>%s's Stats</strong></p>\n", html.EscapeString(ownerName))
+		fmt.Fprintf(w, "<p>Logs per hour of the day in %s.</p>\n", html.EscapeString(tz.String()))
+		fmt.Fprintln(w, "<table style=\"font-family: monospace;\">")
+		fmt.Fprintln(w, "<tr><th>Hour</th><th>Logs</th><th></th></tr>")
+		for hour, c := range counts {
+			var bar string
+			if max > 0 {
+				bar = strings.Repeat("#", c*maxBarWidth/max)
+			}
+			fmt.Fprintf(w, "<tr><td>%02d:00</td><td>%d</td><td>%s</td></tr>\n", hour, c, bar)
+		}
+		fmt.Fprintln(w, "</table>")
+		printHTMLFoot(w)
+		slog.Info("Served hours request.")
+	}
+}
+
+// stopwords are common words left out of the top terms.
+var stopwords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "but": true, "by": true, "for": true, "from": true, "had": true,
+	"has": true, "have": true, "i": true, "i'm": true, "in": true, "is": true,
+	"it": true, "it's": true, "its": true, "me": true, "my": true, "of": true,
+	"on": true, "or": true, "so": true, "that": true, "the": true, "this": true,
+	"to": true, "was": true, "we": true, "were": true, "with": true, "you": true,
+}
+
+type termCount struct {
+	term  string
+	count int
+}
+
+// topTerms returns the n most used words in logs, most used first, ignoring
+// case, punctuation and stopwords. Ties are broken alphabetically.
+func topTerms(logs []log, n int) []termCount {
+	counts := map[string]int{}
+	for _, l := range logs {
+		words := strings.FieldsFunc(strings.ToLower(l.content), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '\''
+		})
+		for _, w := range words {
+			w = strings.Trim(w, "'")
+			if w != "" && !stopwords[w] {
+				counts[w]++
+			}
+		}
+	}
+	terms := make([]termCount, 0, len(counts))
+	for t, c := range counts {
+		terms = append(terms, termCount{t, c})
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if terms[i].count != terms[j].count {
+			return terms[i].count > terms[j].count
+		}
+		return terms[i].term < terms[j].term
+	})
+	if len(terms) > n {
+		terms = terms[:n]
+	}
+	return terms
+}
+
+// Number of terms shown by /stats/terms by default, and at most.
+const (
+	defaultTerms = 50
+	maxTerms     = 500
+)
+
+func termsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n := defaultTerms
+		if v := r.URL.Query().Get("n"); v != "" {
+			var err error
+			if n, err = strconv.Atoi(v); err != nil || n < 1 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		if n > maxTerms {
+			n = maxTerms
+		}
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		logs, err := fetchLogs(ctx, db, filter{allStreams: true})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		terms := topTerms(logs, n)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		printHTMLHead(w, ownerName+"'s Stats")
+		fmt.Fprintf(w, "<p><strong>%s's Stats</strong></p>\n", html.EscapeString(ownerName))
+		fmt.Fprintf(w, "<p>The %d most used words.</p>\n", len(terms))
+		fmt.Fprintln(w, "<table>")
+		fmt.Fprintln(w, "<tr><th>Word</th><th>Uses</th></tr>")
+		for _, t := range terms {
+			fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td></tr>\n", html.EscapeString(t.term), t.count)
+		}
+		fmt.Fprintln(w, "</table>")
+		printHTMLFoot(w)
+		slog.Info("Served terms request.")
+	}
+}
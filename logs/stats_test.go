@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCountLogsByDay(t *testing.T) {
+	db := testDB(t)
+	// The same day in UTC, but different days in New York.
+	mustInsert(t, db,
+		log{ts: time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC), content: "late"},
+		log{ts: time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), content: "noon"},
+	)
+	tz, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err := countLogsByDay(context.Background(), db, tz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 {
+		t.Fatalf("got %d days, want 2", len(counts))
+	}
+	for i, want := range []string{"2024-01-02", "2024-01-01"} {
+		if got := counts[i].day.Format("2006-01-02"); got != want || counts[i].count != 1 {
+			t.Errorf("day %d: got %d logs on %s, want 1 on %s", i, counts[i].count, got, want)
+		}
+	}
+}
+
+func TestAddDayCounts(t *testing.T) {
+	tz, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := []dayCount{
+		{time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), 2},
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 1},
+	}
+	counts = addDayCounts(counts, []log{
+		// The 2nd of January in New York.
+		{ts: time.Date(2024, 1, 3, 3, 0, 0, 0, time.UTC)},
+		{ts: time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC)},
+		{ts: time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)},
+	}, tz)
+	var got []string
+	for _, dc := range counts {
+		got = append(got, fmt.Sprintf("%s:%d", dc.day.Format("2006-01-02"), dc.count))
+	}
+	if want := []string{"2024-01-03:3", "2024-01-02:1", "2024-01-01:1", "2020-06-01:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestCountLogsByDayLegacy(t *testing.T) {
+	db := testDB(t)
+	testLegacyPool(t,
+		[2]string{"2020-01-02T12:00:00Z", "legacy"},
+		[2]string{"2020-01-03T12:00:00Z", "migrated"},
+	)
+	mustInsert(t, db, log{ts: time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC), content: "migrated"})
+	counts, err := countLogsByDay(context.Background(), db, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 || counts[0].count != 1 || counts[1].count != 1 {
+		t.Errorf("got %+v, want one log on each day", counts)
+	}
+}
+
+func TestCountLogsByHourLegacy(t *testing.T) {
+	db := testDB(t)
+	testLegacyPool(t,
+		[2]string{"2020-01-02T05:00:00Z", "legacy"},
+		[2]string{"2020-01-03T07:00:00Z", "migrated"},
+	)
+	mustInsert(t, db, log{ts: time.Date(2020, 1, 3, 7, 0, 0, 0, time.UTC), content: "migrated"})
+	counts, err := countLogsByHour(context.Background(), db, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[5] != 1 || counts[7] != 1 {
+		t.Errorf("got %v, want one log at 05:00 and one at 07:00", counts)
+	}
+}
+
+func TestAddHourCounts(t *testing.T) {
+	tz, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counts [24]int
+	counts[3] = 1
+	addHourCounts(&counts, []log{
+		{ts: time.Date(2024, 1, 3, 8, 30, 0, 0, time.UTC)},
+		{ts: time.Date(2024, 1, 3, 23, 0, 0, 0, time.UTC)},
+	}, tz)
+	var want [24]int
+	want[3], want[18] = 2, 1
+	if counts != want {
+		t.Errorf("got %v, want %v", counts, want)
+	}
+}
+
+func TestCountLogsByHour(t *testing.T) {
+	db := testDB(t)
+	mustInsert(t, db,
+		log{ts: time.Date(2024, 1, 2, 14, 5, 0, 0, time.UTC), content: "one"},
+		log{ts: time.Date(2024, 1, 3, 14, 55, 0, 0, time.UTC), content: "two"},
+		log{ts: time.Date(2024, 1, 3, 2, 0, 0, 0, time.UTC), content: "three"},
+	)
+	tz, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err := countLogsByHour(context.Background(), db, tz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 14:00 and 02:00 UTC are 09:00 and 21:00 in New York in winter.
+	var want [24]int
+	want[9], want[21] = 2, 1
+	if counts != want {
+		t.Errorf("got %v, want %v", counts, want)
+	}
+}
+
+func TestTopTerms(t *testing.T) {
+	logs := []log{
+		{content: "Coffee, coffee and COFFEE!"},
+		{content: "I'm drinking 'tea' with the team."},
+		{content: "Tea at 10"},
+	}
+	want := []termCount{{"coffee", 3}, {"tea", 2}, {"10", 1}, {"drinking", 1}}
+	if got := topTerms(logs, 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := topTerms(nil, 4); len(got) != 0 {
+		t.Errorf("with no logs: got %v", got)
+	}
+}
+
+func TestTermsHandler(t *testing.T) {
+	for _, n := range []string{"0", "-1", "ten"} {
+		w := httptest.NewRecorder()
+		// The n parameter is checked before the database is queried.
+		termsHandler(nil)(w, httptest.NewRequest("GET", "/stats/terms?n="+n, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("n=%s: got status %d, want %d", n, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	db := testDB(t)
+	mustInsert(t, db,
+		log{ts: time.Now(), content: "coffee then <b>coffee</b>"},
+		log{ts: time.Now(), content: "more coffee", stream: "work"},
+	)
+	w := httptest.NewRecorder()
+	termsHandler(db)(w, httptest.NewRequest("GET", "/stats/terms?n=1", nil))
+	body := w.Body.String()
+	for _, want := range []string{"<p>The 1 most used words.</p>", "<tr><td>coffee</td><td>3</td></tr>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %q in:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// streams are the names of the log streams kept apart from the default one,
+// like "work". Each is served under its own path prefix, as in /work/, and
+// stored in the stream column. Parsed from STREAMS in run.
+var streams map[string]bool
+
+var streamNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// parseStreams parses a comma-separated list of stream names.
+func parseStreams(v string) (map[string]bool, error) {
+	names := map[string]bool{}
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !streamNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid stream name %q", name)
+		}
+		if findTelegramCommand("/"+name) != nil {
+			return nil, fmt.Errorf("stream name %q is a Telegram command", name)
+		}
+		names[name] = true
+	}
+	return names, nil
+}
+
+// streamPath returns the path of the index of stream, where "" is the
+// default stream.
+func streamPath(stream string) string {
+	if stream == "" {
+		return "/"
+	}
+	return "/" + stream + "/"
+}
+
+// inStream serves requests as part of stream.
+func inStream(stream string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r.WithContext(context.WithValue(r.Context(), streamKey, stream)))
+	}
+}
+
+// streamOf returns the stream r is for, or "" for the default stream.
+func streamOf(r *http.Request) string {
+	stream, _ := r.Context().Value(streamKey).(string)
+	return stream
+}
+
+// parseStreamPrefix returns the stream a Telegram message is for and the rest
+// of its text. Messages starting with "/work" followed by some text go to the
+// work stream, and everything else goes to the default stream, unchanged.
+func parseStreamPrefix(text string) (string, string) {
+	i := strings.IndexFunc(text, unicode.IsSpace)
+	if !strings.HasPrefix(text, "/") || i < 0 || !streams[text[1:i]] {
+		return "", text
+	}
+	// Only the prefix is removed, so that Telegram's entity offsets can be
+	// shifted by its length.
+	rest := strings.TrimLeftFunc(text[i:], unicode.IsSpace)
+	if rest == "" {
+		return "", text
+	}
+	return text[1:i], rest
+}
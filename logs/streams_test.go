@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStreams(t *testing.T) {
+	got, err := parseStreams(" work, personal,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]bool{"work": true, "personal": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, err := parseStreams(""); err != nil || len(got) != 0 {
+		t.Errorf("empty: got %v, %v", got, err)
+	}
+	for _, v := range []string{"Work", "my stream", "-work", "work/", "today", "undo"} {
+		if _, err := parseStreams(v); err == nil {
+			t.Errorf("%q: got no error", v)
+		}
+	}
+}
+
+func TestParseStreamPrefix(t *testing.T) {
+	setConfig(t, &streams, map[string]bool{"work": true})
+	tests := []struct {
+		text, stream, rest string
+	}{
+		{"/work shipped it", "work", "shipped it"},
+		{"/work\n  on two lines", "work", "on two lines"},
+		{"/work", "", "/work"},
+		{"/work   ", "", "/work   "},
+		{"/personal hello", "", "/personal hello"},
+		{"/workout done", "", "/workout done"},
+		{"work from home", "", "work from home"},
+	}
+	for _, tt := range tests {
+		stream, rest := parseStreamPrefix(tt.text)
+		if stream != tt.stream || rest != tt.rest {
+			t.Errorf("parseStreamPrefix(%q) = %q, %q, want %q, %q", tt.text, stream, rest, tt.stream, tt.rest)
+		}
+	}
+}
+
+func TestInStream(t *testing.T) {
+	if p := streamPath(""); p != "/" {
+		t.Errorf("got path %q for the default stream, want /", p)
+	}
+	if p := streamPath("work"); p != "/work/" {
+		t.Errorf("got path %q for work, want /work/", p)
+	}
+	var got []string
+	h := func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, streamOf(r))
+	}
+	inStream("work", h)(httptest.NewRecorder(), httptest.NewRequest("GET", "/work/", nil))
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if want := []string{"work", ""}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got streams %q, want %q", got, want)
+	}
+}
+
+func TestPostgresWhereStreams(t *testing.T) {
+	tests := []struct {
+		f     filter
+		where string
+		args  []interface{}
+	}{
+		{filter{}, " WHERE deleted_at IS NULL AND stream IS NULL", nil},
+		{filter{stream: "work"}, " WHERE deleted_at IS NULL AND stream = $1", []interface{}{"work"}},
+		{filter{stream: "work", allStreams: true}, " WHERE deleted_at IS NULL", nil},
+		{filter{stream: "work", query: "x"}, " WHERE deleted_at IS NULL AND stream = $1 AND content ILIKE '%' || $2 || '%'", []interface{}{"work", "x"}},
+	}
+	for _, tt := range tests {
+		where, args := postgresWhere(tt.f)
+		if where != tt.where || !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("%+v: got %q %v, want %q %v", tt.f, where, args, tt.where, tt.args)
+		}
+	}
+}
+
+func TestStreamRouting(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &streams, map[string]bool{"work": true})
+	setConfig(t, &telegramUsername, "owner")
+	h := telegramHandler(db, time.UTC)
+	for i, text := range []string{"/work shipped it #release", "went for a run #run"} {
+		update := fmt.Sprintf(`{"message": {"message_id": %d, "text": %q, "chat": {"id": 1}, "from": {"username": "owner"}}}`, i+1, text)
+		if w := postTelegram(h, update); w.Code != 200 {
+			t.Fatalf("%q: got status %d: %s", text, w.Code, w.Body)
+		}
+	}
+	ctx := context.Background()
+	for _, tt := range []struct {
+		stream, content, tag string
+	}{
+		{"work", "shipped it #release", "release"},
+		{"", "went for a run #run", "run"},
+	} {
+		logs, err := fetchLogs(ctx, db, filter{stream: tt.stream})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(logs) != 1 || logs[0].content != tt.content {
+			t.Errorf("stream %q: got %+v, want %q", tt.stream, logs, tt.content)
+		}
+		tags, err := fetchTags(ctx, db, tt.stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{tt.tag}; !reflect.DeepEqual(tags, want) {
+			t.Errorf("stream %q: got tags %q, want %q", tt.stream, tags, want)
+		}
+	}
+
+	tmpl, err := parseTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	inStream("work", getHandler(db, time.UTC, tmpl))(w, httptest.NewRequest("GET", "/work/", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "shipped it") || strings.Contains(body, "went for a run") {
+		t.Errorf("the work index doesn't show just the work logs:\n%s", body)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+)
+
+// A tag is a '#' followed by word characters, at the start of the content or
+// after a character which can't be part of a word (so "a#b" isn't a tag).
+var tagRe = regexp.MustCompile(`(?:^|[^\w#])#(\w+)`)
+
+// extractTags returns the distinct, lowercased hashtags in content, in order
+// of first appearance.
+func extractTags(content string) []string {
+	var tags []string
+	seen := map[string]bool{}
+	for _, m := range tagRe.FindAllStringSubmatch(content, -1) {
+		tag := strings.ToLower(m[1])
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// insertTags associates tags with the log with the given id.
+func insertTags(ctx context.Context, tx *sql.Tx, id int64, tags []string) error {
+	for _, tag := range tags {
+		stmt := "INSERT INTO tags (log_id, tag) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+		if _, err := tx.ExecContext(ctx, stmt, id, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchTags returns every tag used by a log in stream which isn't deleted,
+// alphabetically. The default stream is "".
+func fetchTags(ctx context.Context, db *sql.DB, stream string) ([]string, error) {
+	stmt := "SELECT DISTINCT tag FROM tags JOIN logs ON logs.id = tags.log_id WHERE logs.deleted_at IS NULL AND logs.stream IS NOT DISTINCT FROM $1 ORDER BY tag"
+	rows, err := db.QueryContext(ctx, stmt, nullString(stream))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExtractTags(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{"no tags here", nil},
+		{"#work on the #Health plan #work", []string{"work", "health"}},
+		{"done (#work), then #gym!", []string{"work", "gym"}},
+		{"#start and end#", []string{"start"}},
+		{"a#b and ##double and # alone", nil},
+		{"line one\n#second_line", []string{"second_line"}},
+	}
+	for _, tt := range tests {
+		if got := extractTags(tt.content); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("extractTags(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestFetchLogsByTag(t *testing.T) {
+	db := testDB(t)
+	now := time.Now()
+	mustInsert(t, db,
+		log{ts: now.Add(-time.Minute), content: "standup #work"},
+		log{ts: now, content: "ran 5k #health"},
+	)
+	logs, err := fetchLogs(context.Background(), db, filter{tag: "work"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].content != "standup #work" {
+		t.Errorf("got %+v, want the #work log", logs)
+	}
+	tags, err := fetchTags(context.Background(), db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"health", "work"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("got tags %q, want %q", tags, want)
+	}
+}
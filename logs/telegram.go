@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Used to send messages through the Telegram Bot API. Replies are disabled if
+// telegramBotToken is empty.
+var (
+	telegramAPI    = "https://api.telegram.org"
+	telegramClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// The maximum length of a Telegram message, in characters.
+const maxTelegramMessageLen = 4096
+
+// sendTelegramMessage sends text to the chat with the given id.
+func sendTelegramMessage(chatID int64, text string) error {
+	if telegramBotToken == "" {
+		return errors.New("TELEGRAM_BOT_TOKEN is not set")
+	}
+	if utf8.RuneCountInString(text) > maxTelegramMessageLen {
+		text = string([]rune(text)[:maxTelegramMessageLen-1]) + "…"
+	}
+	body, err := json.Marshal(struct {
+		ChatID int64  `json:"chat_id"`
+		Text   string `json:"text"`
+	}{chatID, text})
+	if err != nil {
+		return err
+	}
+	url := telegramAPI + "/bot" + telegramBotToken + "/sendMessage"
+	resp, err := telegramClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("telegram sendMessage returned %s", resp.Status)
+	}
+	return nil
+}
+
+// todaySummary lists the logs made today in the given timezone.
+func todaySummary(ctx context.Context, db *sql.DB, tz *time.Location) (string, error) {
+	now := time.Now().In(tz)
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, tz)
+	logs, err := fetchLogs(ctx, db, filter{from: start, to: now, asc: true, allStreams: true})
+	if err != nil {
+		return "", err
+	}
+	if len(logs) == 0 {
+		return "No logs today.", nil
+	}
+	var sb strings.Builder
+	for _, l := range logs {
+		fmt.Fprintf(&sb, "(%s) %s\n", l.ts.In(tz).Format(timeFormat), l.content)
+	}
+	return sb.String(), nil
+}
+
+// validTelegramSecret reports whether r carries the Telegram secret, either in
+// the header set through setWebhook's secret_token or in the key parameter.
+func validTelegramSecret(r *http.Request) bool {
+	var key string
+	if v := r.Header.Get("X-Telegram-Bot-Api-Secret-Token"); v != "" {
+		key = v
+	} else if !telegramStrict {
+		key = r.URL.Query().Get("key")
+	}
+	if key == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(key), []byte(telegramSecret)) == 1
+}
+
+// backdateRe matches a leading timestamp like "@2024-06-01 14:30", used to
+// log something which happened earlier. backdateTimeRe matches a bare time.
+var (
+	backdateRe     = regexp.MustCompile(`^@(\d{4}-\d{2}-\d{2}(?:[ T]\d{1,2}:\d{2})?)\s+`)
+	backdateTimeRe = regexp.MustCompile(`^\d{1,2}:\d{2}$`)
+)
+
+// parseBackdate returns the timestamp given at the start of text, in tz, and
+// the rest of the text. If there isn't a valid one, it returns now and text.
+func parseBackdate(text string, tz *time.Location, now time.Time) (time.Time, string) {
+	m := backdateRe.FindStringSubmatch(text)
+	if m == nil {
+		return now, text
+	}
+	// Only the prefix is removed, so that Telegram's entity offsets can be
+	// shifted by its length.
+	rest := text[len(m[0]):]
+	// Don't treat "@2024-06-01 14:30" on its own as a log of "14:30".
+	if strings.TrimSpace(rest) == "" || backdateTimeRe.MatchString(strings.TrimSpace(rest)) {
+		return now, text
+	}
+	for _, layout := range []string{"2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if ts, err := time.ParseInLocation(layout, m[1], tz); err == nil {
+			return ts, rest
+		}
+	}
+	return now, text
+}
+
+// The kinds of Telegram update logs are created from, stored in the source
+// column.
+const (
+	sourceMessage     = "message"
+	sourceChannelPost = "channel_post"
+)
+
+// parseChannelIDs parses a comma-separated list of Telegram chat ids.
+func parseChannelIDs(v string) (map[int64]bool, error) {
+	ids := map[int64]bool{}
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(f, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel id %q", f)
+		}
+		ids[id] = true
+	}
+	return ids, nil
+}
+
+type telegramChat struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+}
+
+type telegramUser struct {
+	ID        int    `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Username  string `json:"username"`
+}
+
+type telegramMessage struct {
+	MessageID int64        `json:"message_id"`
+	Text      string       `json:"text"`
+	Entities  []entity     `json:"entities"`
+	Chat      telegramChat `json:"chat"`
+	From      telegramUser `json:"from"`
+
+	source string // The kind of update the message came in, like sourceMessage.
+}
+
+// telegramCommandFunc handles a message sent to the bot.
+type telegramCommandFunc func(ctx context.Context, db *sql.DB, tz *time.Location, msg telegramMessage) error
+
+// telegramCommand is a command which can be sent to the bot instead of a log.
+type telegramCommand struct {
+	names       []string // The first is listed by /help, the rest are aliases.
+	description string
+	run         telegramCommandFunc
+}
+
+// telegramCommands are the commands the bot understands, in the order /help
+// lists them. Messages which aren't commands are handled by logMessage.
+var telegramCommands = []telegramCommand{
+	{names: []string{"/undo", "/delete"}, description: "delete the latest log", run: undoCommand},
+	{names: []string{"/today"}, description: "list today's logs", run: todayCommand},
+}
+
+// telegramCommandsByName indexes telegramCommands by each of their names.
+var telegramCommandsByName = map[string]*telegramCommand{}
+
+func init() {
+	// Registered here, as the help text refers back to telegramCommands.
+	telegramCommands = append(telegramCommands, telegramCommand{
+		names:       []string{"/help", "/start"},
+		description: "show this message",
+		run:         helpCommand,
+	})
+	for i, c := range telegramCommands {
+		for _, name := range c.names {
+			telegramCommandsByName[name] = &telegramCommands[i]
+		}
+	}
+}
+
+// findTelegramCommand returns the command text invokes, or nil if it's not a
+// command. In groups, commands may be suffixed with the bot's name, as in
+// "/today@logsbot".
+func findTelegramCommand(text string) *telegramCommand {
+	text = strings.TrimSpace(text)
+	if i := strings.IndexByte(text, '@'); i > 0 {
+		text = text[:i]
+	}
+	return telegramCommandsByName[text]
+}
+
+// dispatchTelegram runs the command msg invokes, or logs it if it isn't one.
+// Commands are only taken from direct messages.
+func dispatchTelegram(ctx context.Context, db *sql.DB, tz *time.Location, msg telegramMessage) error {
+	if cmd := findTelegramCommand(msg.Text); cmd != nil && msg.source == sourceMessage {
+		return cmd.run(ctx, db, tz, msg)
+	}
+	return logMessage(ctx, db, tz, msg)
+}
+
+// telegramLog returns the log for msg, received at now, and whether its text
+// backdated it. Any stream prefix and backdate are removed from the content.
+func telegramLog(msg telegramMessage, tz *time.Location, now time.Time) (log, bool) {
+	stream, text := parseStreamPrefix(msg.Text)
+	ts, content := parseBackdate(text, tz, now)
+	return log{
+		ts:        ts,
+		content:   content,
+		entities:  shiftEntities(msg.Entities, utf16Len(msg.Text)-utf16Len(content)),
+		author:    msg.From.Username,
+		messageID: msg.MessageID,
+		chatID:    msg.Chat.ID,
+		source:    msg.source,
+		stream:    stream,
+	}, content != text
+}
+
+// logMessage inserts msg as a log, in the stream it starts with if any, and
+// backdated if it then starts with a timestamp.
+func logMessage(ctx context.Context, db *sql.DB, tz *time.Location, msg telegramMessage) error {
+	l, backdated := telegramLog(msg, tz, time.Now())
+	if err := insertLog(ctx, db, l); err != nil {
+		return err
+	}
+	metrics.observeTelegramInsert()
+	slog.Info("Ingested log.", "source", msg.source, "chat_id", msg.Chat.ID, "message_id", msg.MessageID, "stream", l.stream, "backdated", backdated)
+	return nil
+}
+
+func undoCommand(ctx context.Context, db *sql.DB, tz *time.Location, msg telegramMessage) error {
+	if err := deleteLatestLog(ctx, db); err != nil {
+		return err
+	}
+	slog.Info("Deleted latest log.")
+	return nil
+}
+
+func todayCommand(ctx context.Context, db *sql.DB, tz *time.Location, msg telegramMessage) error {
+	summary, err := todaySummary(ctx, db, tz)
+	if err != nil {
+		return err
+	}
+	if err := sendTelegramMessage(msg.Chat.ID, summary); err != nil {
+		return err
+	}
+	slog.Info("Sent today's logs.")
+	return nil
+}
+
+// helpText describes how to use the bot.
+func helpText() string {
+	var sb strings.Builder
+	sb.WriteString("Send a message to log it. Start it with a time like @2024-06-01 14:30 to backdate it.\n")
+	if len(streams) > 0 {
+		names := make([]string, 0, len(streams))
+		for name := range streams {
+			names = append(names, "/"+name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&sb, "Start it with %s to log it in that stream instead.\n", strings.Join(names, " or "))
+	}
+	sb.WriteString("\nCommands:\n")
+	for _, c := range telegramCommands {
+		sb.WriteString(c.names[0])
+		if len(c.names) > 1 {
+			fmt.Fprintf(&sb, " (or %s)", strings.Join(c.names[1:], ", "))
+		}
+		fmt.Fprintf(&sb, " - %s\n", c.description)
+	}
+	return sb.String()
+}
+
+func helpCommand(ctx context.Context, db *sql.DB, tz *time.Location, msg telegramMessage) error {
+	if err := sendTelegramMessage(msg.Chat.ID, helpText()); err != nil {
+		return err
+	}
+	slog.Info("Sent help.")
+	return nil
+}
+
+// telegramAuth rejects requests without the Telegram secret. It goes in front
+// of the rate limit, so that other clients can't use it up and lock Telegram
+// out.
+func telegramAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validTelegramSecret(r) {
+			slog.Info("Invalid key.")
+			http.Error(w, "invalid secret key", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// telegramHandler handles Telegram webhook updates. It must be wrapped in
+// telegramAuth.
+func telegramHandler(db *sql.DB, tz *time.Location) http.HandlerFunc {
+	type webhook struct {
+		Message       *telegramMessage `json:"message"`
+		EditedMessage *telegramMessage `json:"edited_message"`
+		ChannelPost   *telegramMessage `json:"channel_post"`
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		var wh webhook
+		if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+			slog.Info("Failed to decode request from Telegram.")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var msg telegramMessage
+		switch {
+		case wh.EditedMessage != nil:
+			msg = *wh.EditedMessage
+			msg.source = sourceMessage
+		case wh.Message != nil:
+			msg = *wh.Message
+			msg.source = sourceMessage
+		case wh.ChannelPost != nil:
+			msg = *wh.ChannelPost
+			msg.source = sourceChannelPost
+		default:
+			// Some other kind of update, which there's nothing to log for.
+			slog.Info("Ignoring update without a message.")
+			return
+		}
+		if msg.source == sourceChannelPost {
+			// Channel posts have no sender, so the channel itself must be
+			// allowed instead.
+			if !telegramChannels[msg.Chat.ID] {
+				slog.Info("Ignoring post from channel.", "chat_id", msg.Chat.ID)
+				return
+			}
+			// Attribute the post to the channel.
+			msg.From.Username = msg.Chat.Title
+		} else if msg.From.Username != telegramUsername {
+			slog.Warn("Ignoring message from unknown sender.", "expected", telegramUsername, "username", msg.From.Username)
+			// If this message is from an unknown sender, ignore it.
+			return
+		}
+		if strings.TrimSpace(msg.Text) == "" {
+			// Stickers, photos and the like have no text. Acknowledge them
+			// so Telegram doesn't retry, but there's nothing to log.
+			slog.Info("Ignoring message without text.")
+			return
+		}
+		text, err := limitContent(msg.Text)
+		if err != nil {
+			// Acknowledge the message anyway, as Telegram retries anything
+			// but a 200 and the message will never get shorter.
+			slog.Warn("Dropped log which is too long.", "bytes", len(msg.Text), "max", maxContentLen)
+			if telegramBotToken != "" {
+				reply := fmt.Sprintf("Not logged, as it's longer than %d bytes.", maxContentLen)
+				if err := sendTelegramMessage(msg.Chat.ID, reply); err != nil {
+					slog.Error("Failed to reply to Telegram message.", "err", err)
+				}
+			}
+			return
+		}
+		msg.Text = text
+		ctx, cancel := queryContext(r)
+		defer cancel()
+		if wh.EditedMessage != nil {
+			// Edits are parsed like new messages, so they can backdate too.
+			l, backdated := telegramLog(msg, tz, time.Now())
+			found, err := updateLog(ctx, db, l, backdated)
+			if err != nil {
+				slog.Error("Failed to update edited log.", "err", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if found {
+				slog.Info("Updated edited log.")
+				return
+			}
+			// The original message was never ingested, so ingest the edit
+			// as a new log instead. It's never run as a command: editing a
+			// message into "/undo" mustn't delete anything.
+			if err := logMessage(ctx, db, tz, msg); err != nil {
+				slog.Error("Failed to handle Telegram message.", "err", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if err := dispatchTelegram(ctx, db, tz, msg); err != nil {
+			slog.Error("Failed to handle Telegram message.", "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postTelegram sends the update body to h, as Telegram would.
+func postTelegram(h http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/_wh/telegram", strings.NewReader(body))
+	r.Header.Set("X-Telegram-Bot-Api-Secret-Token", telegramSecret)
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+// sentMessage is a message sent through the Telegram API.
+type sentMessage struct {
+	ChatID int64  `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+// stubTelegram points the Telegram API at a server which records the messages
+// sent through it, with bot token "token", for the rest of the test.
+func stubTelegram(t *testing.T) *[]sentMessage {
+	t.Helper()
+	var sent []sentMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottoken/sendMessage" {
+			http.NotFound(w, r)
+			return
+		}
+		var m sentMessage
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sent = append(sent, m)
+	}))
+	t.Cleanup(srv.Close)
+	setConfig(t, &telegramAPI, srv.URL)
+	setConfig(t, &telegramBotToken, "token")
+	return &sent
+}
+
+func TestTelegramUndo(t *testing.T) {
+	db := testDB(t)
+	now := time.Now()
+	mustInsert(t, db, log{ts: now.Add(-time.Minute), content: "first"}, log{ts: now, content: "second"})
+	h := telegramHandler(db, time.UTC)
+	for _, text := range []string{"/undo", " /delete "} {
+		update := `{"message": {"text": "` + text + `", "from": {"username": "` + telegramUsername + `"}}}`
+		if w := postTelegram(h, update); w.Code != http.StatusOK {
+			t.Fatalf("%q: got status %d: %s", text, w.Code, w.Body)
+		}
+	}
+	logs, err := fetchLogs(context.Background(), db, filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 0 {
+		t.Errorf("got %+v, want no logs", logs)
+	}
+}
+
+func TestTelegramHandlerEditedMessage(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &telegramUsername, "owner")
+	h := telegramHandler(db, time.UTC)
+	if w := postTelegram(h, `{"message": {"message_id": 7, "text": "first #draft", "chat": {"id": 1}, "from": {"username": "owner"}}}`); w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if w := postTelegram(h, `{"edited_message": {"message_id": 7, "text": "second #final", "chat": {"id": 1}, "from": {"username": "owner"}}}`); w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	logs, err := fetchLogs(context.Background(), db, filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].content != "second #final" {
+		t.Fatalf("got %+v, want the edited log only", logs)
+	}
+	tags, err := fetchTags(context.Background(), db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0] != "final" {
+		t.Errorf("got tags %v, want [final]", tags)
+	}
+}
+
+func TestTelegramHandlerUnmatchedEditIsNotACommand(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &telegramUsername, "owner")
+	mustInsert(t, db, log{ts: time.Now(), content: "kept"})
+	h := telegramHandler(db, time.UTC)
+	// No log was created from message 7, so the edit is logged as is.
+	if w := postTelegram(h, `{"edited_message": {"message_id": 7, "text": "/undo", "chat": {"id": 1}, "from": {"username": "owner"}}}`); w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	logs, err := fetchLogs(context.Background(), db, filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].content != "/undo" || logs[1].content != "kept" {
+		t.Errorf("got %+v, want the edit logged and nothing deleted", logs)
+	}
+}
+
+func TestTelegramHandlerStoresMessageIDs(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &telegramUsername, "owner")
+	h := telegramHandler(db, time.UTC)
+	if w := postTelegram(h, `{"message": {"message_id": 42, "text": "hello", "chat": {"id": 1234}, "from": {"username": "owner"}}}`); w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var messageID, chatID int64
+	if err := db.QueryRow("SELECT telegram_message_id, chat_id FROM logs").Scan(&messageID, &chatID); err != nil {
+		t.Fatal(err)
+	}
+	if messageID != 42 || chatID != 1234 {
+		t.Errorf("got message %d in chat %d, want message 42 in chat 1234", messageID, chatID)
+	}
+}
+
+func TestValidTelegramSecret(t *testing.T) {
+	tests := []struct {
+		header, key string
+		strict      bool
+		want        bool
+	}{
+		{"secret", "", false, true},
+		{"secret", "", true, true},
+		{"wrong", "secret", false, false},
+		{"", "secret", false, true},
+		{"", "secret", true, false},
+		{"", "wrong", false, false},
+		{"", "", false, false},
+	}
+	setConfig(t, &telegramSecret, "secret")
+	for _, tt := range tests {
+		setConfig(t, &telegramStrict, tt.strict)
+		r := httptest.NewRequest("POST", "/_wh/telegram?key="+tt.key, nil)
+		if tt.header != "" {
+			r.Header.Set("X-Telegram-Bot-Api-Secret-Token", tt.header)
+		}
+		if got := validTelegramSecret(r); got != tt.want {
+			t.Errorf("header %q, key %q, strict %v: got %v, want %v", tt.header, tt.key, tt.strict, got, tt.want)
+		}
+	}
+}
+
+func TestTelegramAuthBeforeRateLimit(t *testing.T) {
+	h := telegramAuth(rateLimit(newRateLimiter(1), func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("POST", "/_wh/telegram?key=wrong", nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("without the secret: got status %d, want 401", w.Code)
+		}
+	}
+	// The requests without the secret didn't use up the limit.
+	if w := postTelegram(h, "{}"); w.Code != http.StatusOK {
+		t.Errorf("with the secret: got status %d, want 200", w.Code)
+	}
+}
+
+func TestTelegramHandlerAcknowledgesTooLong(t *testing.T) {
+	setConfig(t, &telegramUsername, "owner")
+	setConfig(t, &telegramBotToken, "")
+	setConfig(t, &maxContentLen, 10)
+	setConfig(t, &truncateContent, false)
+	// Dropped before the database is used.
+	w := postTelegram(telegramHandler(nil, time.UTC), `{"message": {"message_id": 1, "text": "much too long", "chat": {"id": 1}, "from": {"username": "owner"}}}`)
+	if w.Code != 200 {
+		t.Errorf("got status %d, want 200 so Telegram doesn't retry", w.Code)
+	}
+}
+
+func TestSendTelegramMessage(t *testing.T) {
+	sent := stubTelegram(t)
+	long := strings.Repeat("é", maxTelegramMessageLen+10)
+	for _, text := range []string{"hello", long} {
+		if err := sendTelegramMessage(42, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(*sent) != 2 {
+		t.Fatalf("got %d messages sent, want 2", len(*sent))
+	}
+	if m := (*sent)[0]; m.ChatID != 42 || m.Text != "hello" {
+		t.Errorf("got %+v", m)
+	}
+	if n := len([]rune((*sent)[1].Text)); n != maxTelegramMessageLen {
+		t.Errorf("long message was sent as %d characters, want %d", n, maxTelegramMessageLen)
+	}
+	setConfig(t, &telegramBotToken, "wrong")
+	if err := sendTelegramMessage(42, "hello"); err == nil {
+		t.Error("with a failing request: got no error")
+	}
+}
+
+func TestTelegramHandlerToday(t *testing.T) {
+	db := testDB(t)
+	sent := stubTelegram(t)
+	setConfig(t, &telegramUsername, "owner")
+	mustInsert(t, db,
+		log{ts: time.Now().Add(-48 * time.Hour), content: "long ago"},
+		log{ts: time.Now(), content: "just now"},
+	)
+	if w := postTelegram(telegramHandler(db, time.UTC), `{"message": {"message_id": 1, "text": "/today", "chat": {"id": 5}, "from": {"username": "owner"}}}`); w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if len(*sent) != 1 || (*sent)[0].ChatID != 5 || !strings.Contains((*sent)[0].Text, "just now") || strings.Contains((*sent)[0].Text, "long ago") {
+		t.Errorf("got %+v sent, want today's log in chat 5", *sent)
+	}
+	logs, err := fetchLogs(context.Background(), db, filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 {
+		t.Errorf("got %d logs, want the command not to be logged", len(logs))
+	}
+}
+
+func TestTelegramHandlerSkipsRedelivery(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &telegramUsername, "owner")
+	h := telegramHandler(db, time.UTC)
+	update := `{"message": {"message_id": 9, "text": "only once", "chat": {"id": 1}, "from": {"username": "owner"}}}`
+	for i := 0; i < 2; i++ {
+		if w := postTelegram(h, update); w.Code != 200 {
+			t.Fatalf("delivery %d: got status %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+	logs, err := fetchLogs(context.Background(), db, filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 {
+		t.Errorf("got %d logs, want 1", len(logs))
+	}
+}
+
+func TestTelegramHandlerIgnoresEmptyText(t *testing.T) {
+	setConfig(t, &telegramUsername, "owner")
+	// A nil database means the test fails if anything is inserted.
+	h := telegramHandler(nil, time.UTC)
+	for _, update := range []string{
+		`{"message": {"message_id": 1, "chat": {"id": 1}, "from": {"username": "owner"}, "sticker": {}}}`,
+		`{"message": {"message_id": 2, "text": "  \n ", "chat": {"id": 1}, "from": {"username": "owner"}}}`,
+		`{"message": {"message_id": 3, "text": "hi", "chat": {"id": 1}, "from": {"username": "stranger"}}}`,
+	} {
+		if w := postTelegram(h, update); w.Code != 200 {
+			t.Errorf("%s: got status %d, want 200", update, w.Code)
+		}
+	}
+}
+
+func TestParseBackdate(t *testing.T) {
+	tz, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, tz)
+	tests := []struct {
+		text     string
+		wantTS   time.Time
+		wantText string
+	}{
+		{"@2024-06-01 14:30 went for a run", time.Date(2024, 6, 1, 14, 30, 0, 0, tz), "went for a run"},
+		{"@2024-06-01T09:05 coffee", time.Date(2024, 6, 1, 9, 5, 0, 0, tz), "coffee"},
+		{"@2024-06-01 a whole day", time.Date(2024, 6, 1, 0, 0, 0, 0, tz), "a whole day"},
+		{"no prefix", now, "no prefix"},
+		{"@2024-13-01 not a month", now, "@2024-13-01 not a month"},
+		{"@2024-06-01 25:00 not an hour", now, "@2024-06-01 25:00 not an hour"},
+		{"@2024-06-01", now, "@2024-06-01"},
+		{"@2024-06-01 14:30", now, "@2024-06-01 14:30"},
+		{"email me @2024-06-01 later", now, "email me @2024-06-01 later"},
+	}
+	for _, tt := range tests {
+		ts, text := parseBackdate(tt.text, tz, now)
+		if !ts.Equal(tt.wantTS) || text != tt.wantText {
+			t.Errorf("parseBackdate(%q) = %v, %q, want %v, %q", tt.text, ts, text, tt.wantTS, tt.wantText)
+		}
+	}
+}
+
+func TestTelegramHandlerEditedBackdate(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &telegramUsername, "owner")
+	h := telegramHandler(db, time.UTC)
+	for _, update := range []string{
+		`{"message": {"message_id": 7, "text": "run", "chat": {"id": 1}, "from": {"username": "owner"}}}`,
+		`{"edited_message": {"message_id": 7, "text": "@2024-06-01 14:30 run", "chat": {"id": 1}, "from": {"username": "owner"}}}`,
+		// Editing it again without the backdate keeps the time.
+		`{"edited_message": {"message_id": 7, "text": "long run", "chat": {"id": 1}, "from": {"username": "owner"}}}`,
+	} {
+		if w := postTelegram(h, update); w.Code != 200 {
+			t.Fatalf("got status %d: %s", w.Code, w.Body)
+		}
+	}
+	l, err := fetchLog(context.Background(), db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 6, 1, 14, 30, 0, 0, time.UTC); l.content != "long run" || !l.ts.Equal(want) {
+		t.Errorf("got %q at %v, want %q at %v", l.content, l.ts, "long run", want)
+	}
+}
+
+func TestDeleteLatestLogIgnoresBackdates(t *testing.T) {
+	db := testDB(t)
+	now := time.Now()
+	// The second log was sent last, but backdated before the first.
+	mustInsert(t, db, log{ts: now, content: "sent first"}, log{ts: now.Add(-time.Hour), content: "sent last"})
+	ctx := context.Background()
+	if err := deleteLatestLog(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	logs, err := fetchLogs(ctx, db, filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].content != "sent first" {
+		t.Errorf("got %+v, want the last sent log deleted", logs)
+	}
+}
+
+func TestParseChannelIDs(t *testing.T) {
+	ids, err := parseChannelIDs(" -1001, 42,,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int64]bool{-1001: true, 42: true}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+	if _, err := parseChannelIDs("-1001,@mychannel"); err == nil {
+		t.Error("got no error for a channel name")
+	}
+}
+
+func TestTelegramHandlerIgnoresUnknownChannels(t *testing.T) {
+	setConfig(t, &telegramChannels, map[int64]bool{-1001: true})
+	// Nothing is stored, so no database is needed.
+	h := telegramHandler(nil, time.UTC)
+	for _, update := range []string{
+		`{"channel_post": {"message_id": 1, "text": "hi", "chat": {"id": -1002, "title": "Other"}}}`,
+		`{"my_chat_member": {}}`,
+	} {
+		if w := postTelegram(h, update); w.Code != 200 {
+			t.Errorf("%s: got status %d, want 200", update, w.Code)
+		}
+	}
+}
+
+func TestTelegramHandlerChannelPost(t *testing.T) {
+	db := testDB(t)
+	setConfig(t, &telegramChannels, map[int64]bool{-1001: true})
+	h := telegramHandler(db, time.UTC)
+	w := postTelegram(h, `{"channel_post": {"message_id": 1, "text": "posted", "chat": {"id": -1001, "title": "Journal"}}}`)
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	l, err := fetchLog(context.Background(), db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.content != "posted" || l.author != "Journal" || l.source != sourceChannelPost || l.chatID != -1001 {
+		t.Errorf("got %+v, want the post stored from the channel", l)
+	}
+}
+
+func TestFindTelegramCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		want string // The first name of the command, or "" for none.
+	}{
+		{"/undo", "/undo"},
+		{"/delete", "/undo"},
+		{"/undo@logsbot", "/undo"},
+		{" /today ", "/today"},
+		{"/start", "/help"},
+		{"/undone", ""},
+		{"undo", ""},
+		{"please /undo", ""},
+	}
+	for _, tt := range tests {
+		cmd := findTelegramCommand(tt.text)
+		got := ""
+		if cmd != nil {
+			got = cmd.names[0]
+		}
+		if got != tt.want {
+			t.Errorf("findTelegramCommand(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestHelpText(t *testing.T) {
+	setConfig(t, &streams, map[string]bool{})
+	text := helpText()
+	for _, want := range []string{"@2024-06-01 14:30", "/undo (or /delete) - delete the latest log\n", "/today - list today's logs\n", "/help (or /start) - show this message\n"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "stream") {
+		t.Errorf("mentions streams without any:\n%s", text)
+	}
+	setConfig(t, &streams, map[string]bool{"work": true, "gym": true})
+	if text := helpText(); !strings.Contains(text, "Start it with /gym or /work to log it in that stream instead.") {
+		t.Errorf("missing the streams in:\n%s", text)
+	}
+}
+
+func TestTelegramHandlerHelp(t *testing.T) {
+	sent := stubTelegram(t)
+	setConfig(t, &telegramUsername, "owner")
+	// Help isn't logged, so no database is needed.
+	h := telegramHandler(nil, time.UTC)
+	for _, text := range []string{"/help", "/start", "/help@logsbot"} {
+		w := postTelegram(h, `{"message": {"message_id": 1, "text": "`+text+`", "chat": {"id": 42}, "from": {"username": "owner"}}}`)
+		if w.Code != 200 {
+			t.Fatalf("%s: got status %d: %s", text, w.Code, w.Body)
+		}
+	}
+	if len(*sent) != 3 {
+		t.Fatalf("got %d messages sent, want 3", len(*sent))
+	}
+	for _, m := range *sent {
+		if m.ChatID != 42 || m.Text != helpText() {
+			t.Errorf("got %+v, want the help text sent to chat 42", m)
+		}
+	}
+}
+
+func TestDispatchTelegram(t *testing.T) {
+	var ran []string
+	command := func(name string) *telegramCommand {
+		return &telegramCommand{names: []string{name}, run: func(ctx context.Context, db *sql.DB, tz *time.Location, msg telegramMessage) error {
+			ran = append(ran, name+" "+msg.Text)
+			return nil
+		}}
+	}
+	setConfig(t, &telegramCommandsByName, map[string]*telegramCommand{"/one": command("/one"), "/two": command("/two")})
+	ctx := context.Background()
+	for _, text := range []string{"/one", "/two@logsbot", "/one"} {
+		// Commands don't log anything, so no database is needed.
+		if err := dispatchTelegram(ctx, nil, time.UTC, telegramMessage{Text: text, source: sourceMessage}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"/one /one", "/two /two@logsbot", "/one /one"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("got %q, want %q", ran, want)
+	}
+}
+
+func TestDispatchTelegramDefault(t *testing.T) {
+	db := testDB(t)
+	ran := false
+	setConfig(t, &telegramCommandsByName, map[string]*telegramCommand{"/one": {names: []string{"/one"}, run: func(ctx context.Context, db *sql.DB, tz *time.Location, msg telegramMessage) error {
+		ran = true
+		return nil
+	}}})
+	ctx := context.Background()
+	msgs := []telegramMessage{
+		{MessageID: 1, Text: "not a command", source: sourceMessage},
+		// Commands are only taken from direct messages.
+		{MessageID: 2, Text: "/one", source: sourceChannelPost},
+	}
+	for _, msg := range msgs {
+		if err := dispatchTelegram(ctx, db, time.UTC, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ran {
+		t.Error("ran a command from a channel post")
+	}
+	logs, err := fetchLogs(ctx, db, filter{asc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].content != "not a command" || logs[1].content != "/one" {
+		t.Errorf("got %+v, want both messages logged", logs)
+	}
+}
+
+func TestTelegramLog(t *testing.T) {
+	setConfig(t, &streams, map[string]bool{"work": true})
+	now := time.Date(2024, 6, 10, 12, 0, 0, 0, time.UTC)
+	msg := telegramMessage{
+		MessageID: 7,
+		Text:      "/work @2024-06-01 14:30 shipped it",
+		// "shipped" is bold.
+		Entities: []entity{{Type: "bold", Offset: 24, Length: 7}},
+		Chat:     telegramChat{ID: 1},
+		From:     telegramUser{Username: "owner"},
+		source:   sourceMessage,
+	}
+	l, backdated := telegramLog(msg, time.UTC, now)
+	want := log{
+		ts:        time.Date(2024, 6, 1, 14, 30, 0, 0, time.UTC),
+		content:   "shipped it",
+		entities:  []entity{{Type: "bold", Offset: 0, Length: 7}},
+		author:    "owner",
+		messageID: 7,
+		chatID:    1,
+		source:    sourceMessage,
+		stream:    "work",
+	}
+	if !backdated || !reflect.DeepEqual(l, want) {
+		t.Errorf("got %+v, %v, want %+v, true", l, backdated, want)
+	}
+	msg.Text, msg.Entities = "just now", nil
+	if l, backdated := telegramLog(msg, time.UTC, now); backdated || !l.ts.Equal(now) || l.stream != "" {
+		t.Errorf("without prefixes: got %+v, %v", l, backdated)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The RFC 6238 parameters used by authenticator apps by default.
+const (
+	totpStep   = 30 * time.Second
+	totpDigits = 6
+)
+
+// totpKey is the decoded TOTP_SECRET. If set, the web view can also be
+// unlocked with a code from an authenticator app. Parsed in run.
+var totpKey []byte
+
+// How long a session cookie set after entering a code lasts.
+const totpSessionLength = 30 * 24 * time.Hour
+
+const totpCookie = "logs_session"
+
+// parseTOTPSecret decodes a base32 secret, as shown by authenticator apps,
+// ignoring case, spaces and padding.
+func parseTOTPSecret(v string) ([]byte, error) {
+	v = strings.ToUpper(strings.ReplaceAll(v, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < 10 {
+		return nil, errors.New("secret too short, must be at least 80 bits")
+	}
+	return key, nil
+}
+
+// totpCounter returns the number of the step containing t.
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpStep/time.Second)
+}
+
+// totpCode returns the code for the step containing t, per RFC 4226 and 6238.
+func totpCode(key []byte, t time.Time) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(totpCounter(t)))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0xf
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", n%1000000)
+}
+
+// validTOTP reports whether code is the code at now, or one step either side
+// of it to allow for clock drift, and if so the counter of the step it's for.
+func validTOTP(key []byte, code string, now time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	var (
+		counter int64
+		valid   bool
+	)
+	for _, skew := range []time.Duration{-totpStep, 0, totpStep} {
+		t := now.Add(skew)
+		if subtle.ConstantTimeCompare([]byte(code), []byte(totpCode(key, t))) == 1 {
+			counter, valid = totpCounter(t), true
+		}
+	}
+	return counter, valid
+}
+
+// signSession returns the value of a session cookie expiring at expires. It's
+// signed with a key derived from the TOTP secret, so changing the secret
+// logs everyone out.
+func signSession(key []byte, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("session:" + exp))
+	return exp + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSession reports whether r carries an unexpired session cookie.
+func validSession(r *http.Request, key []byte, now time.Time) bool {
+	c, err := r.Cookie(totpCookie)
+	if err != nil {
+		return false
+	}
+	exp, _, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now.Unix() >= unix {
+		return false
+	}
+	want := signSession(key, time.Unix(unix, 0))
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(want)) == 1
+}
+
+// printTOTPForm writes the page asking for a code, which returns to next.
+func printTOTPForm(w http.ResponseWriter, next string, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	printHTMLHead(w, ownerName+"'s Logs")
+	fmt.Fprintf(w, "<p><strong>%s's Logs</strong></p>\n", html.EscapeString(ownerName))
+	if message != "" {
+		fmt.Fprintf(w, "<p>%s</p>\n", html.EscapeString(message))
+	}
+	fmt.Fprintln(w, `<form action="/login" method="post">`)
+	fmt.Fprintf(w, "<input type=\"hidden\" name=\"next\" value=\"%s\" />\n", html.EscapeString(next))
+	fmt.Fprintln(w, `<input type="text" name="code" inputmode="numeric" pattern="[0-9]{6}" autocomplete="one-time-code" required autofocus />`)
+	fmt.Fprintln(w, `<button type="submit">Unlock</button>`)
+	fmt.Fprintln(w, "</form>")
+	printHTMLFoot(w)
+}
+
+// localPath returns next if it's a path on this site, or "/" otherwise, so
+// the login form can't be used to redirect elsewhere.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// Codes are short, so guessing must be slow. After maxLoginFailures wrong
+// codes in a row a client is locked out for loginLockout, and twice as long
+// again after each further wrong code, up to maxLoginLockout. Failures are
+// forgotten once a client has made none for maxLoginLockout.
+const (
+	maxLoginFailures = 5
+	loginLockout     = time.Minute
+	maxLoginLockout  = 24 * time.Hour
+)
+
+// Maximum number of clients a loginGuard keeps track of before it forgets
+// those which aren't locked out.
+const maxLoginClients = 10000
+
+// loginFailures are the recent failed logins of a client.
+type loginFailures struct {
+	count int
+	last  time.Time // When the last one was.
+	until time.Time // When the client is locked out until, if it is.
+}
+
+// loginGuard locks out clients which keep entering wrong codes, and stops
+// codes from being used more than once. Locking out clients one by one,
+// rather than slowing down logins altogether, means that someone guessing
+// codes can't lock the owner out too, as long as clientAddr tells them apart:
+// behind a proxy, that needs TRUST_PROXY. It's only kept in memory, so it's
+// reset on restart.
+type loginGuard struct {
+	mu      sync.Mutex
+	clients map[string]*loginFailures
+	used    int64 // The counter of the last step a code was accepted for.
+}
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{clients: map[string]*loginFailures{}}
+}
+
+// locked returns how much longer client is locked out for at now, if at all.
+func (g *loginGuard) locked(client string, now time.Time) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.clients[client]; ok && now.Before(f.until) {
+		return f.until.Sub(now)
+	}
+	return 0
+}
+
+// fail records a wrong code entered by client at now.
+func (g *loginGuard) fail(client string, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f, ok := g.clients[client]
+	if !ok || now.Sub(f.last) > maxLoginLockout {
+		if len(g.clients) >= maxLoginClients {
+			for c, f := range g.clients {
+				if !now.Before(f.until) {
+					delete(g.clients, c)
+				}
+			}
+		}
+		f = &loginFailures{}
+		g.clients[client] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= maxLoginFailures {
+		d := loginLockout
+		for i := maxLoginFailures; i < f.count && d < maxLoginLockout; i++ {
+			d *= 2
+		}
+		if d > maxLoginLockout {
+			d = maxLoginLockout
+		}
+		f.until = now.Add(d)
+	}
+}
+
+// accept records that client entered the valid code for the step with the
+// given counter, reporting false if a code for it, or a later step, was
+// already accepted.
+func (g *loginGuard) accept(client string, counter int64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if counter <= g.used {
+		return false
+	}
+	g.used = counter
+	delete(g.clients, client)
+	return true
+}
+
+// loginHandler checks a code from the form, setting a session cookie if it's
+// valid.
+func loginHandler() http.HandlerFunc {
+	guard := newLoginGuard()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if totpKey == nil {
+			http.NotFound(w, r)
+			return
+		}
+		next := localPath(r.PostFormValue("next"))
+		now := time.Now()
+		client := clientAddr(r)
+		if d := guard.locked(client, now); d > 0 {
+			slog.Info("Rejected login from locked out client.", "client", client)
+			w.Header().Set("Retry-After", strconv.Itoa(int(d.Round(time.Second)/time.Second)))
+			printTOTPForm(w, next, http.StatusTooManyRequests, "Too many wrong codes, try again in "+d.Round(time.Second).String()+".")
+			return
+		}
+		counter, ok := validTOTP(totpKey, r.PostFormValue("code"), now)
+		if !ok {
+			guard.fail(client, now)
+			slog.Info("Rejected login code.", "client", client)
+			printTOTPForm(w, next, http.StatusUnauthorized, "That code isn't valid.")
+			return
+		}
+		if !guard.accept(client, counter) {
+			slog.Warn("Rejected reused login code.", "client", client)
+			printTOTPForm(w, next, http.StatusUnauthorized, "That code was already used, wait for the next one.")
+			return
+		}
+		expires := now.Add(totpSessionLength)
+		http.SetCookie(w, &http.Cookie{
+			Name:     totpCookie,
+			Value:    signSession(totpKey, expires),
+			Path:     "/",
+			Expires:  expires,
+			Secure:   r.TLS != nil,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+		slog.Info("Served login request.")
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+}
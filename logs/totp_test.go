@@ -0,0 +1,268 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The key of the RFC 6238 test vectors, "12345678901234567890" in base32.
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func testTOTPKey(t *testing.T) []byte {
+	t.Helper()
+	key, err := parseTOTPSecret(testTOTPSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestTOTPCode(t *testing.T) {
+	key := testTOTPKey(t)
+	// The SHA-1 vectors from RFC 6238, which are 8 digits long, cut to the
+	// last 6.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, time.Unix(tt.unix, 0)); got != tt.want {
+			t.Errorf("at %d: got %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestParseTOTPSecret(t *testing.T) {
+	for _, v := range []string{testTOTPSecret, "gezd gnbv gy3t qojq gezd gnbv gy3t qojq", testTOTPSecret + "===="} {
+		key, err := parseTOTPSecret(v)
+		if err != nil || string(key) != "12345678901234567890" {
+			t.Errorf("%q: got %q, %v", v, key, err)
+		}
+	}
+	for _, v := range []string{"not base32!", "GEZDGNBV"} {
+		if _, err := parseTOTPSecret(v); err == nil {
+			t.Errorf("%q: got no error", v)
+		}
+	}
+}
+
+func TestValidTOTP(t *testing.T) {
+	key := testTOTPKey(t)
+	now := time.Unix(1111111111, 0)
+	step := totpCounter(now)
+	tests := []struct {
+		code    string
+		counter int64 // 0 if the code isn't valid.
+	}{
+		{"050471", step},
+		{" 050471 ", step},
+		{totpCode(key, now.Add(-totpStep)), step - 1},
+		{totpCode(key, now.Add(totpStep)), step + 1},
+		{totpCode(key, now.Add(-2*totpStep)), 0},
+		{totpCode(key, now.Add(2*totpStep)), 0},
+		{"05047", 0},
+		{"0504710", 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		counter, ok := validTOTP(key, tt.code, now)
+		if ok != (tt.counter != 0) || counter != tt.counter {
+			t.Errorf("%q: got %d, %v, want %d", tt.code, counter, ok, tt.counter)
+		}
+	}
+}
+
+func TestLoginGuard(t *testing.T) {
+	g := newLoginGuard()
+	now := time.Unix(1700000000, 0)
+	for i := 1; i < maxLoginFailures; i++ {
+		g.fail("a", now)
+	}
+	if d := g.locked("a", now); d != 0 {
+		t.Errorf("after %d failures: locked out for %v", maxLoginFailures-1, d)
+	}
+	g.fail("a", now)
+	if d := g.locked("a", now); d != loginLockout {
+		t.Errorf("after %d failures: got %v, want %v", maxLoginFailures, d, loginLockout)
+	}
+	if d := g.locked("b", now); d != 0 {
+		t.Errorf("another client is locked out for %v", d)
+	}
+	g.fail("a", now)
+	if d := g.locked("a", now); d != 2*loginLockout {
+		t.Errorf("after another failure: got %v, want %v", d, 2*loginLockout)
+	}
+	for i := 0; i < 20; i++ {
+		g.fail("a", now)
+	}
+	if d := g.locked("a", now); d != maxLoginLockout {
+		t.Errorf("after many failures: got %v, want %v", d, maxLoginLockout)
+	}
+	// Failures are forgotten after a quiet day.
+	later := now.Add(maxLoginLockout + time.Minute)
+	g.fail("a", later)
+	if d := g.locked("a", later); d != 0 {
+		t.Errorf("a day later: locked out for %v", d)
+	}
+
+	if !g.accept("a", 100) {
+		t.Error("rejected the first code")
+	}
+	if g.locked("a", later) != 0 || g.clients["a"] != nil {
+		t.Error("a valid code didn't reset the failures")
+	}
+	if g.accept("b", 100) || g.accept("b", 99) {
+		t.Error("accepted a code for a step which was already used")
+	}
+	if !g.accept("b", 101) {
+		t.Error("rejected the next code")
+	}
+}
+
+func TestSession(t *testing.T) {
+	key := testTOTPKey(t)
+	now := time.Unix(1700000000, 0)
+	withCookie := func(value string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		if value != "" {
+			r.AddCookie(&http.Cookie{Name: totpCookie, Value: value})
+		}
+		return r
+	}
+	valid := signSession(key, now.Add(time.Hour))
+	if !validSession(withCookie(valid), key, now) {
+		t.Error("rejected a valid session")
+	}
+	exp, sig, _ := strings.Cut(valid, ".")
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"expired", signSession(key, now.Add(-time.Second))},
+		{"expiring now", signSession(key, now)},
+		{"other key", signSession([]byte("another key"), now.Add(time.Hour))},
+		{"extended", "9999999999." + sig},
+		{"tampered", exp + "." + strings.Repeat("0", len(sig))},
+		{"malformed", "not a session"},
+		{"missing", ""},
+	}
+	for _, tt := range tests {
+		if validSession(withCookie(tt.value), key, now) {
+			t.Errorf("%s: accepted %q", tt.name, tt.value)
+		}
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct{ next, want string }{
+		{"/", "/"},
+		{"/?tag=work", "/?tag=work"},
+		{"/work/", "/work/"},
+		{"", "/"},
+		{"https://evil.example.com/", "/"},
+		{"//evil.example.com/", "/"},
+		{"/\\evil.example.com/", "/"},
+		{"evil", "/"},
+	}
+	for _, tt := range tests {
+		if got := localPath(tt.next); got != tt.want {
+			t.Errorf("localPath(%q) = %q, want %q", tt.next, got, tt.want)
+		}
+	}
+}
+
+// postLogin submits the login form to h from the client at addr.
+func postLogin(h http.HandlerFunc, addr, code, next string) *httptest.ResponseRecorder {
+	form := url.Values{"code": {code}, "next": {next}}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = addr
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestLoginHandler(t *testing.T) {
+	key := testTOTPKey(t)
+	setConfig(t, &totpKey, nil)
+	if w := postLogin(loginHandler(), "192.0.2.1:1234", "123456", "/"); w.Code != http.StatusNotFound {
+		t.Errorf("without TOTP_SECRET: got status %d, want 404", w.Code)
+	}
+	setConfig(t, &totpKey, key)
+	h := loginHandler()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/login", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: got status %d, want 405", w.Code)
+	}
+
+	code := totpCode(key, time.Now())
+	w = postLogin(h, "192.0.2.1:1234", code, "/?tag=work")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/?tag=work" {
+		t.Fatalf("valid code: got status %d to %q, want 303 to /?tag=work", w.Code, w.Header().Get("Location"))
+	}
+	resp := w.Result()
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("got cookies %v, want an HttpOnly session", cookies)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	if !validSession(r, key, time.Now()) {
+		t.Error("the session cookie isn't valid")
+	}
+	if w := postLogin(h, "192.0.2.1:1234", code, "/"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "already used") {
+		t.Errorf("reused code: got status %d:\n%s", w.Code, w.Body)
+	}
+
+	// Never a valid code, as codes are digits.
+	wrong := "abcdef"
+	for i := 0; i < maxLoginFailures; i++ {
+		w = postLogin(h, "192.0.2.2:1234", wrong, "//evil.example.com/")
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("wrong code: got status %d, want 401", w.Code)
+		}
+		if strings.Contains(w.Body.String(), "evil.example.com") {
+			t.Errorf("the form returns to another site:\n%s", w.Body)
+		}
+	}
+	w = postLogin(h, "192.0.2.2:1234", totpCode(key, time.Now()), "/")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("locked out: got status %d with Retry-After %q, want 429 and 60", w.Code, w.Header().Get("Retry-After"))
+	}
+	// Other clients aren't locked out.
+	if w := postLogin(h, "192.0.2.3:1234", "", "/"); w.Code != http.StatusUnauthorized {
+		t.Errorf("another client: got status %d, want 401", w.Code)
+	}
+}
+
+func TestBasicAuthSession(t *testing.T) {
+	key := testTOTPKey(t)
+	setConfig(t, &totpKey, key)
+	setConfig(t, &webUser, "")
+	setConfig(t, &webPassword, "")
+	h := basicAuth(func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/?tag=work", nil))
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), `value="/?tag=work"`) {
+		t.Errorf("without a session: got status %d:\n%s", w.Code, w.Body)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: totpCookie, Value: signSession(key, time.Now().Add(time.Hour))})
+	w = httptest.NewRecorder()
+	h(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("with a session: got status %d, want 200", w.Code)
+	}
+}
@@ -6,20 +6,56 @@ import (
 	"database/sql"
 	"errors"
 	"flag"
+	"fmt"
 	logger "log"
+	"os"
 	"time"
 
 	"crawshaw.io/sqlite/sqlitex"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+func fallback(key, fv string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fv
+}
+
 var (
-	sqlitePath  = flag.String("sqlite-path", "lp", "path to sqlite db")
-	postgresUrl = flag.String("postgres-path", "pp", "postgres url")
+	sqlitePath  = flag.String("sqlite-path", fallback("SQLITE_PATH", ""), "path to sqlite db, defaults to $SQLITE_PATH (required)")
+	postgresUrl = flag.String("postgres-path", "", "postgres url (required)")
+	since       = flag.String("since", "", "only migrate logs after this RFC3339 timestamp")
+	dryRun      = flag.Bool("dry-run", false, "read logs and check the postgres connection without inserting anything")
 )
 
+// validateFlags checks that the required flags were given and point at
+// something which exists.
+func validateFlags() error {
+	if *sqlitePath == "" {
+		return errors.New("missing -sqlite-path")
+	}
+	if *postgresUrl == "" {
+		return errors.New("missing -postgres-path")
+	}
+	if _, err := os.Stat(*sqlitePath); err != nil {
+		return fmt.Errorf("invalid -sqlite-path: %w", err)
+	}
+	if *since != "" {
+		if _, err := time.Parse(time.RFC3339, *since); err != nil {
+			return fmt.Errorf("invalid -since: %w", err)
+		}
+	}
+	return nil
+}
+
 func main() {
 	flag.Parse()
+	if err := validateFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
 	if err := run(); err != nil {
 		logger.Fatal(err)
 	}
@@ -31,6 +67,12 @@ type log struct {
 }
 
 func existingLogs() ([]log, error) {
+	busyTimeout, err := time.ParseDuration(fallback("SQLITE_BUSY_TIMEOUT", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SQLITE_BUSY_TIMEOUT: %w", err)
+	}
+	// The default flags open the database in WAL mode, so reading doesn't
+	// block a server which is still writing to it.
 	pool, err := sqlitex.Open(*sqlitePath, 0, 10)
 	if err != nil {
 		return nil, err
@@ -41,10 +83,12 @@ func existingLogs() ([]log, error) {
 		return nil, errors.New("failed to get sqlite conn from pool")
 	}
 	defer pool.Put(conn)
+	conn.SetBusyTimeout(busyTimeout)
 
 	logs := []log{}
 	// We order by ASC to insert them into the proper order into the Postgres DB.
-	stmt := conn.Prep(`SELECT ts, content FROM logs ORDER BY datetime(ts) ASC;`)
+	stmt := conn.Prep(`SELECT ts, content FROM logs WHERE $since = '' OR datetime(ts) > datetime($since) ORDER BY datetime(ts) ASC;`)
+	stmt.SetText("$since", *since)
 	for {
 		if hasNext, err := stmt.Step(); err != nil {
 			return nil, err
@@ -62,30 +106,103 @@ func existingLogs() ([]log, error) {
 }
 
 func migratePostgres(conn *sql.DB) error {
-	stmt := `CREATE TABLE IF NOT EXISTS logs (id SERIAL PRIMARY KEY, timestamp TIMESTAMPTZ, content TEXT);`
-	_, err := conn.Exec(stmt)
-	return err
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS logs (id SERIAL PRIMARY KEY, timestamp TIMESTAMPTZ, content TEXT);`,
+		// Only some of the server's columns. It adds the rest, like
+		// deleted_at and stream, when it starts. Migrated logs leave these
+		// NULL.
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS telegram_message_id BIGINT;`,
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS chat_id BIGINT;`,
+		`ALTER TABLE logs ADD COLUMN IF NOT EXISTS author TEXT;`,
+		// So insertLogs can find logs which were already copied without
+		// scanning the table for each one. It isn't unique, as the server
+		// may log the same thing twice at the same time.
+		`CREATE INDEX IF NOT EXISTS logs_timestamp_idx ON logs (timestamp);`,
+	}
+	for _, stmt := range stmts {
+		if _, err := conn.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func insertLogs(logs []log) error {
-	db, err := sql.Open("postgres", *postgresUrl)
-	if err != nil {
-		return err
+// How often insertLogs reports its progress, in logs.
+const progressInterval = 1000
+
+// verifyLogs checks that every one of logs is present in the PostgreSQL DB, as
+// seen by tx.
+func verifyLogs(tx *sql.Tx, logs []log) error {
+	type key struct {
+		ts      time.Time
+		content string
 	}
-	defer db.Close()
-	if err := db.Ping(); err != nil {
+	seen := map[key]bool{}
+	var tss, contents []string
+	for _, l := range logs {
+		k := key{l.ts.UTC(), l.content}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		tss = append(tss, l.ts.UTC().Format(time.RFC3339Nano))
+		contents = append(contents, l.content)
+	}
+	var n int
+	stmt := `SELECT count(*) FROM (SELECT DISTINCT timestamp, content FROM logs
+		WHERE (timestamp, content) IN (SELECT * FROM unnest($1::timestamptz[], $2::text[]))) AS present;`
+	if err := tx.QueryRow(stmt, pq.Array(tss), pq.Array(contents)).Scan(&n); err != nil {
 		return err
 	}
+	if n != len(tss) {
+		return fmt.Errorf("expected %d logs in PostgreSQL, found %d", len(tss), n)
+	}
+	return nil
+}
+
+func insertLogs(db *sql.DB, logs []log) error {
 	if err := migratePostgres(db); err != nil {
 		return err
 	}
-	stmt := `INSERT INTO logs (timestamp, content) VALUES ($1, $2);`
-	for _, l := range logs {
-		if _, err := db.Exec(stmt, l.ts, l.content); err != nil {
+	// All logs are inserted in a single transaction, so a failure part way
+	// through doesn't leave the Postgres DB partially migrated.
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// Logs which were already copied by a previous run are skipped, looked
+	// up through logs_timestamp_idx.
+	stmt, err := tx.Prepare(`INSERT INTO logs (timestamp, content) SELECT $1::timestamptz, $2::text
+		WHERE NOT EXISTS (SELECT 1 FROM logs WHERE timestamp = $1 AND content = $2);`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	var inserted int64
+	for i, l := range logs {
+		if i > 0 && i%progressInterval == 0 {
+			logger.Printf("Processed %d/%d logs.", i, len(logs))
+		}
+		res, err := stmt.Exec(l.ts.UTC(), l.content)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
 			return err
 		}
+		inserted += n
+	}
+	// Check before committing, so nothing is migrated if any log is
+	// missing.
+	if err := verifyLogs(tx, logs); err != nil {
+		return err
 	}
-	logger.Printf("Inserted %d logs into PostgreSQL.", len(logs))
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logger.Printf("Inserted %d logs into PostgreSQL, skipped %d already present.", inserted, int64(len(logs))-inserted)
 	return nil
 }
 
@@ -94,5 +211,29 @@ func run() error {
 	if err != nil {
 		return err
 	}
-	return insertLogs(logs)
+	db, err := sql.Open("postgres", *postgresUrl)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return err
+	}
+	if *dryRun {
+		if len(logs) == 0 {
+			logger.Println("Dry run: no logs to migrate.")
+			return nil
+		}
+		logger.Printf("Dry run: would migrate %d logs from %s to %s.", len(logs),
+			logs[0].ts.Format(time.RFC3339), logs[len(logs)-1].ts.Format(time.RFC3339))
+		return nil
+	}
+	if err := insertLogs(db, logs); err != nil {
+		return err
+	}
+	if len(logs) > 0 {
+		last := logs[len(logs)-1].ts.Format(time.RFC3339)
+		logger.Printf("Migrated logs up to %s, run with -since=%s to continue from here.", last, last)
+	}
+	return nil
 }
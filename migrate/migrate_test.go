@@ -0,0 +1,281 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+// setFlag sets the flag at p to v for the rest of the test.
+func setFlag[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// legacyDB creates an SQLite database in the server's old schema holding rows
+// of timestamps and content, and points -sqlite-path at it.
+func legacyDB(t *testing.T, rows ...[2]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mglogs.db")
+	conn, err := sqlite.OpenConn(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := sqlitex.Exec(conn, "CREATE TABLE logs (ts TEXT, content TEXT);", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range rows {
+		if err := sqlitex.Exec(conn, "INSERT INTO logs (ts, content) VALUES (?, ?);", nil, row[0], row[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setFlag(t, &sqlitePath, &path)
+	return path
+}
+
+// testURL returns the URL of a schema of its own in the database at
+// TEST_DATABASE_URL, emptied, skipping the test if it isn't set. The schema
+// keeps these tests apart from the server's, which run at the same time.
+func testURL(t *testing.T) string {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if _, err := admin.Exec("DROP SCHEMA IF EXISTS migrate_test CASCADE; CREATE SCHEMA migrate_test"); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	q.Set("search_path", "migrate_test")
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// testDB returns the database at testURL.
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("postgres", testURL(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// countRows returns the number of rows in the logs table of db.
+func countRows(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT count(*) FROM logs").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestInsertLogs(t *testing.T) {
+	db := testDB(t)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	// More than progressInterval, so progress is reported along the way.
+	logs := make([]log, 2500)
+	for i := range logs {
+		logs[i] = log{ts: start.Add(time.Duration(i) * time.Minute), content: fmt.Sprintf("log %d", i)}
+	}
+	if err := insertLogs(db, logs); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db); n != len(logs) {
+		t.Errorf("got %d rows, want %d", n, len(logs))
+	}
+}
+
+func TestInsertLogsSkipsMigrated(t *testing.T) {
+	db := testDB(t)
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	logs := []log{{ts: ts, content: "one"}, {ts: ts.Add(time.Minute), content: "two"}}
+	if err := insertLogs(db, logs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertLogs(db, logs); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, db); n != 2 {
+		t.Errorf("got %d rows, want 2", n)
+	}
+	// The server may still log the same thing twice at the same time.
+	if _, err := db.Exec("INSERT INTO logs (timestamp, content) VALUES ($1, 'one')", ts); err != nil {
+		t.Errorf("inserting a duplicate failed: %v", err)
+	}
+}
+
+func TestMigratePostgresIndexesTimestamp(t *testing.T) {
+	db := testDB(t)
+	if err := migratePostgres(db); err != nil {
+		t.Fatal(err)
+	}
+	// Running it again, as every migration does, is fine.
+	if err := migratePostgres(db); err != nil {
+		t.Fatal(err)
+	}
+	var def string
+	if err := db.QueryRow("SELECT indexdef FROM pg_indexes WHERE schemaname = 'migrate_test' AND indexname = 'logs_timestamp_idx'").Scan(&def); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(def, "UNIQUE") {
+		t.Errorf("got %q, want a non-unique index", def)
+	}
+}
+
+func TestExistingLogs(t *testing.T) {
+	legacyDB(t,
+		[2]string{"2020-01-02T00:00:00Z", "second"},
+		[2]string{"2020-01-01T00:00:00Z", "first"},
+	)
+	logs, err := existingLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 2 || logs[0].content != "first" || logs[1].content != "second" {
+		t.Errorf("got %+v, want both logs, oldest first", logs)
+	}
+}
+
+func TestExistingLogsDuringWrite(t *testing.T) {
+	path := legacyDB(t, [2]string{"2020-01-01T00:00:00Z", "committed"})
+	// Hold a write transaction open, as the server might.
+	conn, err := sqlite.OpenConn(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := sqlitex.Exec(conn, "BEGIN IMMEDIATE;", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer sqlitex.Exec(conn, "ROLLBACK;", nil)
+	if err := sqlitex.Exec(conn, "INSERT INTO logs (ts, content) VALUES ('2020-01-02T00:00:00Z', 'uncommitted');", nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SQLITE_BUSY_TIMEOUT", "100ms")
+	logs, err := existingLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].content != "committed" {
+		t.Errorf("got %+v, want only the committed log", logs)
+	}
+}
+
+func TestExistingLogsInvalidBusyTimeout(t *testing.T) {
+	legacyDB(t)
+	t.Setenv("SQLITE_BUSY_TIMEOUT", "soon")
+	if _, err := existingLogs(); err == nil {
+		t.Error("got no error")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dsn := testURL(t)
+	legacyDB(t, [2]string{"2020-01-01T00:00:00Z", "one"})
+	setFlag(t, &postgresUrl, &dsn)
+	dry := true
+	setFlag(t, &dryRun, &dry)
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var table sql.NullString
+	if err := db.QueryRow("SELECT to_regclass('logs')::text").Scan(&table); err != nil {
+		t.Fatal(err)
+	}
+	if table.Valid {
+		t.Error("dry run created the logs table")
+	}
+}
+
+func TestValidateFlags(t *testing.T) {
+	path := legacyDB(t)
+	missing := filepath.Join(t.TempDir(), "missing.db")
+	tests := []struct {
+		name                    string
+		sqlite, postgres, since string
+		ok                      bool
+	}{
+		{"valid", path, "postgres://localhost/logs", "", true},
+		{"valid since", path, "postgres://localhost/logs", "2020-01-01T00:00:00Z", true},
+		{"no sqlite path", "", "postgres://localhost/logs", "", false},
+		{"no postgres url", path, "", "", false},
+		{"missing sqlite file", missing, "postgres://localhost/logs", "", false},
+		{"invalid since", path, "postgres://localhost/logs", "2020-01-01", false},
+	}
+	for _, tt := range tests {
+		setFlag(t, &sqlitePath, &tt.sqlite)
+		setFlag(t, &postgresUrl, &tt.postgres)
+		setFlag(t, &since, &tt.since)
+		if err := validateFlags(); (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
+
+func TestVerifyLogs(t *testing.T) {
+	db := testDB(t)
+	if err := migratePostgres(db); err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := db.Exec("INSERT INTO logs (timestamp, content) VALUES ($1, 'present')", ts); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	present := log{ts: ts, content: "present"}
+	if err := verifyLogs(tx, []log{present, present}); err != nil {
+		t.Errorf("with a log twice: %v", err)
+	}
+	if err := verifyLogs(tx, []log{present, {ts: ts, content: "missing"}}); err == nil {
+		t.Error("with a missing log: got no error")
+	}
+}
+
+func TestExistingLogsSince(t *testing.T) {
+	legacyDB(t,
+		[2]string{"2020-01-01T00:00:00Z", "old"},
+		[2]string{"2020-01-02T00:00:00Z", "at the cutoff"},
+		[2]string{"2020-01-03T00:00:00Z", "new"},
+	)
+	cutoff := "2020-01-02T00:00:00Z"
+	setFlag(t, &since, &cutoff)
+	logs, err := existingLogs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || logs[0].content != "new" {
+		t.Errorf("got %+v, want only the log after the cutoff", logs)
+	}
+}